@@ -0,0 +1,154 @@
+package etch
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ThreadSubject is a thread listed in subject.txt of a board.
+type ThreadSubject struct {
+	Key      string `json:"key"`
+	Title    string `json:"title"`
+	ResCount int    `json:"resCount"`
+	URL      string `json:"url"` // of the dat
+}
+
+// Board is a board whose subject.txt is cached.
+type Board struct {
+	Host         string    `json:"host"`
+	Name         string    `json:"board"`
+	URL          string    `json:"url"` // of subject.txt
+	Threads      int       `json:"threads"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// Lines of subject.txt, "<key>.dat<>title (count)", or of machi BBS,
+// "<key>.cgi,title(count)"
+var subjectLinePattern = regexp.MustCompile(`^(\d+)\.(?:dat|cgi)(?:<>|,)(.*?)\s*\((\d+)\)\s*$`)
+
+func isSubjectUrl(u *url.URL) bool {
+	return path.Base(u.Path) == "subject.txt"
+}
+
+// datUrl returns the URL of the dat of key listed in subject.txt at
+// subjectUrl.
+func datUrl(subjectUrl *url.URL, key string) *url.URL {
+	u := *subjectUrl
+	u.Path = path.Join(path.Dir(subjectUrl.Path), "dat", key+".dat")
+	u.RawPath = ""
+	u.RawQuery = ""
+	return &u
+}
+
+func parseSubjects(r io.Reader, subjectUrl *url.URL) ([]*ThreadSubject, error) {
+	subjects := make([]*ThreadSubject, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := decodeShiftJIS(scanner.Bytes())
+
+		m := subjectLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		resCount, _ := strconv.Atoi(m[3])
+		subjects = append(subjects, &ThreadSubject{
+			Key:      m[1],
+			Title:    m[2],
+			ResCount: resCount,
+			URL:      datUrl(subjectUrl, m[1]).String(),
+		})
+	}
+
+	return subjects, scanner.Err()
+}
+
+// Subjects parses the cached subject.txt.
+func (cacheEntry *CacheEntry) Subjects() ([]*ThreadSubject, error) {
+	content, err := cacheEntry.OpenContent()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	return parseSubjects(content, cacheEntry.URL)
+}
+
+// Boards returns the boards whose subject.txt is cached.
+func (cache *Cache) Boards() []*Board {
+	boards := make([]*Board, 0)
+
+	for _, u := range cache.Keys() {
+		if !isSubjectUrl(u) {
+			continue
+		}
+
+		board := &Board{
+			Host: u.Host,
+			Name: strings.Trim(path.Dir(u.Path), "/"),
+			URL:  u.String(),
+		}
+
+		meta, err := cache.GetEntry(u).GetMeta()
+		if err != nil {
+			warningf(cache, "Reading meta of %s: %s", u, err)
+		} else if meta != nil {
+			board.Threads = meta.LineCount
+			board.LastModified = meta.LastModified
+		}
+
+		boards = append(boards, board)
+	}
+
+	return boards
+}
+
+// BoardEntry returns the cache entry of subject.txt of the board.
+func (cache *Cache) BoardEntry(host, board string) (*CacheEntry, error) {
+	for _, u := range cache.Keys() {
+		if isSubjectUrl(u) && u.Host == host && path.Dir(u.Path) == "/"+board {
+			return cache.GetEntry(u), nil
+		}
+	}
+
+	return nil, &os.PathError{Op: "open", Path: host + "/" + board, Err: os.ErrNotExist}
+}
+
+// broadcastSubjectChanges compares subject.txt just stored with previous
+// one, and broadcasts threads created and whose response counts changed.
+// Nothing is broadcast for the first subject.txt of a board.
+func (proxy *ProxyServer) broadcastSubjectChanges(cacheEntry *CacheEntry, previous []*ThreadSubject) {
+	if previous == nil {
+		return
+	}
+
+	subjects, err := cacheEntry.Subjects()
+	if err != nil {
+		warningf(cacheEntry, "Parsing subject.txt: %s", err)
+		return
+	}
+
+	resCounts := make(map[string]int, len(previous))
+	for _, subject := range previous {
+		resCounts[subject.Key] = subject.ResCount
+	}
+
+	for _, subject := range subjects {
+		u := datUrl(cacheEntry.URL, subject.Key)
+
+		resCount, ok := resCounts[subject.Key]
+		if !ok {
+			proxy.Listeners.Broadcast(ThreadCreatedEvent{URL: u, Title: subject.Title, ResCount: subject.ResCount})
+		} else if resCount != subject.ResCount {
+			proxy.Listeners.Broadcast(ResCountChangedEvent{URL: u, ResCount: subject.ResCount, Previous: resCount})
+		}
+	}
+}
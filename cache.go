@@ -1,114 +1,899 @@
 package etch
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/motemen/etch/dat"
+	"hash"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
-	"path"
-	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	ErrCacheSizeMismatch = errors.New("cache content size does not match")
+	ErrCacheNotFresh     = errors.New("mtime is not fresher than cache entry")
+	ErrCacheWriterDone   = errors.New("cache writer already committed or aborted")
+	ErrCacheChanged      = errors.New("cache content changed while writing")
+)
+
 type Cache struct {
-	Root string
+	Storage Storage
+
+	// Limits of the cache; zero means unlimited. Exceeding entries are
+	// evicted after writes which exceed them and by the sweeper (see
+	// StartSweeper).
+	MaxSize        int64
+	MaxEntries     int
+	EvictionPolicy EvictionPolicy
+	OnEvict        func(*url.URL)
+
+	// Maps equivalent URLs to one, from which the key is made (see
+	// UrlNormalizer); nil means URLs are used as is
+	Normalizer func(*url.URL) *url.URL
+
+	// Encoding at rest of newly written content (EncodingGzip or
+	// EncodingZstd; empty for raw). HostCompression overrides it by host
+	// suffix, and ArchivedCompression applies to dat落ち threads.
+	Compression         string
+	HostCompression     map[string]string
+	ArchivedCompression string
+
+	// How dat落ち threads are retained
+	ArchivedRetention RetentionPolicy
+
+	// Number of snapshots kept for each entry when its content is replaced
+	// non-incrementally (see SavePrevious); zero disables them, though the
+	// last content is still kept for detecting rewritten posts
+	MaxVersions int
+
+	locks         lockTable
+	accessed      accessTable
+	usage         usageTable
+	evicting      int32
+	recompressing keySet
 }
 
+// CacheEntry is a handle to the cache of a URL. Any number of CacheEntry's
+// may exist for one URL, but they share a lock through Cache, so reads and
+// writes on the same URL are serialized process-wide.
 type CacheEntry struct {
 	URL      *url.URL
+	Key      string
 	FilePath string
+	cache    *Cache
+}
+
+// lockTable holds RWMutex's for keys being accessed. Locks are reference
+// counted and removed from the table when nobody holds or waits for them.
+type lockTable struct {
+	sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
 	sync.RWMutex
+	refs int
+}
+
+func (table *lockTable) acquire(key string) *keyLock {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.locks == nil {
+		table.locks = make(map[string]*keyLock)
+	}
+
+	lock, ok := table.locks[key]
+	if !ok {
+		lock = new(keyLock)
+		table.locks[key] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+func (table *lockTable) get(key string) *keyLock {
+	table.Lock()
+	defer table.Unlock()
+
+	return table.locks[key]
+}
+
+func (table *lockTable) release(key string) {
+	table.Lock()
+	defer table.Unlock()
+
+	lock := table.locks[key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(table.locks, key)
+	}
+}
+
+func NewCache(root string) *Cache {
+	storage := &FileStorage{Root: root}
+	if err := storage.RemoveTempFiles(); err != nil {
+		warningf(storage, "Removing temporary files: %s", err)
+	}
+
+	return &Cache{Storage: storage, MaxVersions: 1, Normalizer: (&UrlNormalizer{}).Normalize}
+}
+
+func NewMemoryCache() *Cache {
+	return &Cache{Storage: NewMemoryStorage(), MaxVersions: 1, Normalizer: (&UrlNormalizer{}).Normalize}
 }
 
 func (cache *Cache) UrlToFilePath(url *url.URL) string {
-	s := []string{cache.Root, url.Host}
-	s = append(s, strings.Split(url.Path, "/")...)
-	return path.Join(s...)
+	key := cache.UrlToKey(url)
+	if fs, ok := cache.Storage.(*FileStorage); ok {
+		return fs.FilePath(key)
+	}
+	return key
 }
 
 func (cache *Cache) Keys() []*url.URL {
 	keys := make([]*url.URL, 0)
-	filepath.Walk(cache.Root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			warningf(cache, "Listing keys: %s", err)
-			return err
-		}
 
-		if info.IsDir() {
-			return nil
+	storageKeys, err := cache.Storage.List()
+	if err != nil {
+		warningf(cache, "Listing keys: %s", err)
+	}
+
+	for _, key := range storageKeys {
+		if isSidecarKey(key) {
+			continue
 		}
 
-		relPath, err := filepath.Rel(cache.Root, path)
-		if err == nil {
-			pathParts := filepath.SplitList(relPath)
-			url := &url.URL{Scheme: "http", Host: pathParts[0], Path: strings.Join(pathParts[1:], "/")}
-			keys = append(keys, url)
+		url, err := cache.KeyToUrl(key)
+		if err != nil {
+			warningf(cache, "Listing keys: %s", err)
+			continue
 		}
 
-		return nil
-	})
+		keys = append(keys, url)
+	}
+
 	return keys
 }
 
 func (cache *Cache) GetEntry(url *url.URL) *CacheEntry {
-	filePath := cache.UrlToFilePath(url)
-	return &CacheEntry{URL: url, FilePath: filePath}
+	url = cache.NormalizeUrl(url)
+
+	return &CacheEntry{
+		URL:      url,
+		Key:      cache.UrlToKey(url),
+		FilePath: cache.UrlToFilePath(url),
+		cache:    cache,
+	}
+}
+
+// entryOfKey returns the entry stored at key, which may differ from the key
+// of url after normalization has changed.
+func (cache *Cache) entryOfKey(key string, url *url.URL) *CacheEntry {
+	filePath := key
+	if fs, ok := cache.Storage.(*FileStorage); ok {
+		filePath = fs.FilePath(key)
+	}
+
+	return &CacheEntry{
+		URL:      url,
+		Key:      key,
+		FilePath: filePath,
+		cache:    cache,
+	}
+}
+
+func (cacheEntry *CacheEntry) Lock() {
+	cacheEntry.cache.locks.acquire(cacheEntry.Key).Lock()
+}
+
+func (cacheEntry *CacheEntry) Unlock() {
+	cacheEntry.cache.locks.get(cacheEntry.Key).Unlock()
+	cacheEntry.cache.locks.release(cacheEntry.Key)
+}
+
+func (cacheEntry *CacheEntry) RLock() {
+	cacheEntry.cache.locks.acquire(cacheEntry.Key).RLock()
+}
+
+func (cacheEntry *CacheEntry) RUnlock() {
+	cacheEntry.cache.locks.get(cacheEntry.Key).RUnlock()
+	cacheEntry.cache.locks.release(cacheEntry.Key)
 }
 
 func (cacheEntry *CacheEntry) GetContent() ([]byte, time.Time, error) {
 	cacheEntry.RLock()
 	defer cacheEntry.RUnlock()
 
-	fileInfo, err := os.Stat(cacheEntry.FilePath)
+	cacheEntry.cache.accessed.touch(cacheEntry.Key)
+
+	content, err := cacheEntry.openContent()
 	if err != nil {
 		return nil, time.Time{}, err
 	}
+	defer content.Close()
 
-	content, err := ioutil.ReadFile(cacheEntry.FilePath)
+	data, err := ioutil.ReadAll(content)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 
-	return content, fileInfo.ModTime(), nil
+	return data, content.ModTime, nil
 }
 
-func (cacheEntry *CacheEntry) FreshenContent(content []byte, mtime time.Time) (bool, error) {
-	cacheEntry.Lock()
-	defer cacheEntry.Unlock()
+// GetMeta returns the metadata of the entry. Entries stored before
+// metadata was introduced have none, and nil is returned without error.
+func (cacheEntry *CacheEntry) GetMeta() (*CacheMeta, error) {
+	cacheEntry.RLock()
+	defer cacheEntry.RUnlock()
 
-	tracef(cacheEntry, "FreshenContent()")
+	return cacheEntry.getMeta()
+}
 
-	fileInfo, _ := os.Stat(cacheEntry.FilePath)
+func (cacheEntry *CacheEntry) getMeta() (*CacheMeta, error) {
+	return readMeta(cacheEntry.cache.Storage, cacheEntry.Key)
+}
 
-	if fileInfo != nil && mtime.Before(fileInfo.ModTime()) {
-		infof(cacheEntry, "FreshenContent: mtime is not fresher than cache entry: %s < %s", mtime, cacheEntry)
-		return false, nil
+func readMeta(storage Storage, key string) (*CacheMeta, error) {
+	data, err := storage.Get(metaKey(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	meta := new(CacheMeta)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// OpenContent opens the content for streaming. The returned CacheContent
+// is a snapshot of the time of opening; subsequent appends are not visible.
+// Compressed content is decompressed transparently.
+func (cacheEntry *CacheEntry) OpenContent() (*CacheContent, error) {
+	cacheEntry.RLock()
+	defer cacheEntry.RUnlock()
+
+	cacheEntry.cache.accessed.touch(cacheEntry.Key)
+
+	return cacheEntry.openContent()
+}
+
+func (cacheEntry *CacheEntry) openContent() (*CacheContent, error) {
+	meta, err := cacheEntry.getMeta()
+	if err != nil {
+		warningf(cacheEntry, "Reading meta: %s", err)
+	}
+
+	if meta != nil {
+		return cacheEntry.openContentAs(meta.Encoding, meta.Size)
+	} else {
+		return cacheEntry.openContentAs("", -1)
+	}
+}
+
+// openContentAs opens the content stored in encoding, whose decoded size is
+// size. If encoding is empty, it is sniffed from the content, and if size
+// is unknown (-1), it is computed by decoding.
+func (cacheEntry *CacheEntry) openContentAs(encoding string, size int64) (*CacheContent, error) {
+	storage := cacheEntry.cache.Storage
+
+	fileInfo, err := storage.Stat(cacheEntry.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := storage.Open(cacheEntry.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding == EncodingIdentity {
+		encoding = sniffEncoding(r)
+	}
+
+	if encoding == EncodingIdentity {
+		return &CacheContent{
+			SectionReader: io.NewSectionReader(r, 0, fileInfo.Size()),
+			ModTime:       fileInfo.ModTime(),
+			closer:        r,
+		}, nil
 	}
 
-	dir, _ := path.Split(cacheEntry.FilePath)
+	codec, ok := codecs[encoding]
+	if !ok {
+		r.Close()
+		return nil, fmt.Errorf("unknown encoding: %q", encoding)
+	}
+
+	rawSize := fileInfo.Size()
+	ra := &compressedReaderAt{
+		open: func() (io.ReadCloser, error) {
+			return codec.newReader(io.NewSectionReader(r, 0, rawSize))
+		},
+	}
+
+	if size == -1 {
+		if err := ra.readTail(); err != nil {
+			r.Close()
+			return nil, err
+		}
+		size = ra.size()
+	}
+
+	return &CacheContent{
+		SectionReader: io.NewSectionReader(ra, 0, size),
+		ModTime:       fileInfo.ModTime(),
+		Encoding:      encoding,
+		closer:        &multiCloser{ra, r},
+	}, nil
+}
 
-	if err := os.MkdirAll(dir, 0777); err != nil {
+type CacheContent struct {
+	*io.SectionReader
+	ModTime time.Time
+	// Encoding at rest; content read is always decoded
+	Encoding string
+	closer   io.Closer
+}
+
+func (content *CacheContent) Close() error {
+	return content.closer.Close()
+}
+
+type multiCloser []io.Closer
+
+func (closers multiCloser) Close() error {
+	var err error
+	for _, c := range closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (cacheEntry *CacheEntry) FreshenContent(content []byte, mtime time.Time) (bool, error) {
+	return cacheEntry.FreshenContentWithMeta(content, mtime, nil)
+}
+
+// FreshenContentWithMeta updates the content like FreshenContent, and
+// stores meta alongside it. Size, LineCount and LastModified of meta are
+// filled from content and mtime.
+func (cacheEntry *CacheEntry) FreshenContentWithMeta(content []byte, mtime time.Time, meta *CacheMeta) (bool, error) {
+	w, err := cacheEntry.CreateContent(mtime, meta)
+	if err == ErrCacheNotFresh {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
-	debugf(cacheEntry, "Writing content")
+	return writeAndCommitContent(w, content)
+}
 
-	if err := ioutil.WriteFile(cacheEntry.FilePath, content, 0666); err != nil {
+// AppendContentWithMeta appends delta to the content, which must be exactly
+// offset bytes long; otherwise ErrCacheSizeMismatch is returned and the
+// content is left untouched. Callers should fall back to
+// FreshenContentWithMeta on errors.
+func (cacheEntry *CacheEntry) AppendContentWithMeta(delta []byte, offset int64, mtime time.Time, meta *CacheMeta) (bool, error) {
+	w, err := cacheEntry.AppendContent(offset, mtime, meta)
+	if err == ErrCacheNotFresh {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 
-	debugf(cacheEntry, "Setting mtime to %s", mtime)
+	return writeAndCommitContent(w, delta)
+}
+
+func writeAndCommitContent(w *CacheWriter, content []byte) (bool, error) {
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return false, err
+	}
 
-	if err := os.Chtimes(cacheEntry.FilePath, mtime, mtime); err != nil {
+	if err := w.Commit(); err == ErrCacheNotFresh {
+		return false, nil
+	} else if err != nil {
 		return false, err
+	}
+
+	return true, nil
+}
+
+// CreateContent returns a writer which replaces the whole content on
+// Commit. The entry is not locked while writing, so that readers are not
+// blocked by slow responses; it is locked only on Commit.
+// ErrCacheNotFresh is returned, here or by Commit, if mtime is older than
+// the current content.
+func (cacheEntry *CacheEntry) CreateContent(mtime time.Time, meta *CacheMeta) (*CacheWriter, error) {
+	tracef(cacheEntry, "CreateContent()")
+
+	cacheEntry.RLock()
+	err := cacheEntry.checkFresher(mtime)
+	cacheEntry.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := cacheEntry.cache.encodingFor(cacheEntry.URL, meta != nil && meta.Archived)
+
+	debugf(cacheEntry, "Writing content with mtime %s, encoding %q", mtime, encoding)
+
+	w, err := cacheEntry.cache.Storage.Create(cacheEntry.Key, mtime)
+	if err != nil {
+		return nil, err
+	}
+
+	cw, err := cacheEntry.newWriter(w, encoding, mtime, meta, 0, 0, newContentHash())
+	if err != nil {
+		return nil, err
+	}
+
+	cw.check = func() error {
+		return cacheEntry.checkFresher(mtime)
+	}
+
+	return cw, nil
+}
+
+// checkFresher returns ErrCacheNotFresh if mtime is older than the current
+// content. Must be called with the entry locked.
+func (cacheEntry *CacheEntry) checkFresher(mtime time.Time) error {
+	fileInfo, _ := cacheEntry.cache.Storage.Stat(cacheEntry.Key)
+
+	if fileInfo != nil && mtime.Before(fileInfo.ModTime()) {
+		infof(cacheEntry, "mtime is not fresher than cache entry: %s < %s", mtime, fileInfo.ModTime())
+		return ErrCacheNotFresh
+	}
+
+	return nil
+}
+
+// AppendContent returns a writer which appends to the content, which must
+// be exactly offset bytes long; otherwise ErrCacheSizeMismatch is returned,
+// here or by Commit. Written content is kept in memory and the entry is
+// locked only on Commit, as CreateContent.
+func (cacheEntry *CacheEntry) AppendContent(offset int64, mtime time.Time, meta *CacheMeta) (*CacheWriter, error) {
+	tracef(cacheEntry, "AppendContent()")
+
+	cacheEntry.RLock()
+	encoding, oldMeta, err := cacheEntry.checkAppendable(offset, mtime)
+	cacheEntry.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Line count and hash are carried over from the previous meta if it is
+	// of the same content, so that we need not read the whole content
+	lineCount := -1
+	var (
+		h         hash.Hash
+		hashState []byte
+	)
+	if oldMeta != nil && oldMeta.Size == offset {
+		lineCount = oldMeta.LineCount
+		h = restoreContentHash(oldMeta.HashState)
+		hashState = oldMeta.HashState
+	}
+
+	debugf(cacheEntry, "Appending content with mtime %s, encoding %q", mtime, encoding)
+
+	w := &bufferedAppendWriter{open: func() (StorageWriter, error) {
+		return cacheEntry.cache.Storage.OpenAppend(cacheEntry.Key, mtime)
+	}}
+
+	cw, err := cacheEntry.newWriter(w, encoding, mtime, meta, offset, lineCount, h)
+	if err != nil {
+		return nil, err
+	}
+
+	cw.check = func() error {
+		currentEncoding, currentMeta, err := cacheEntry.checkAppendable(offset, mtime)
+		if err != nil {
+			return err
+		}
+		if currentEncoding != encoding {
+			return ErrCacheChanged
+		}
+
+		// Replaced by content of the same size meanwhile
+		if currentMeta == nil || !bytes.Equal(currentMeta.HashState, hashState) {
+			cw.lineCount = -1
+			cw.hash = nil
+		}
+
+		return nil
+	}
+
+	return cw, nil
+}
+
+// checkAppendable returns the encoding and meta of the content, which must
+// be exactly offset bytes long and not newer than mtime. Must be called
+// with the entry locked.
+func (cacheEntry *CacheEntry) checkAppendable(offset int64, mtime time.Time) (string, *CacheMeta, error) {
+	fileInfo, err := cacheEntry.cache.Storage.Stat(cacheEntry.Key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	oldMeta, _ := cacheEntry.getMeta()
+
+	// Compressed content must be appended in the same encoding, and its
+	// decoded size is known only from meta
+	encoding := EncodingIdentity
+	size := fileInfo.Size()
+	if oldMeta != nil && oldMeta.Encoding != EncodingIdentity {
+		encoding = oldMeta.Encoding
+		size = oldMeta.Size
+	}
+
+	if size != offset {
+		return "", nil, ErrCacheSizeMismatch
+	}
+
+	if mtime.Before(fileInfo.ModTime()) {
+		infof(cacheEntry, "mtime is not fresher than cache entry: %s < %s", mtime, fileInfo.ModTime())
+		return "", nil, ErrCacheNotFresh
+	}
+
+	return encoding, oldMeta, nil
+}
+
+// bufferedAppendWriter keeps the appended content in memory, and appends
+// it to the storage on Commit.
+type bufferedAppendWriter struct {
+	bytes.Buffer
+	open func() (StorageWriter, error)
+}
+
+func (w *bufferedAppendWriter) Commit() error {
+	sw, err := w.open()
+	if err != nil {
+		return err
+	}
+
+	return writeAndCommit(sw, w.Bytes())
+}
+
+func (w *bufferedAppendWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+// newWriter returns a CacheWriter writing to w in encoding. lineCount of -1
+// and nil h mean they are unknown for the existing content.
+func (cacheEntry *CacheEntry) newWriter(w StorageWriter, encoding string, mtime time.Time, meta *CacheMeta, size int64, lineCount int, h hash.Hash) (*CacheWriter, error) {
+	cw := &CacheWriter{entry: cacheEntry, w: w, encoding: encoding, mtime: mtime, meta: meta, size: size, lineCount: lineCount, hash: h}
+
+	if encoding != EncodingIdentity {
+		codec, ok := codecs[encoding]
+		if !ok {
+			w.Abort()
+			return nil, fmt.Errorf("unknown encoding: %q", encoding)
+		}
+
+		enc, err := codec.newWriter(w)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		cw.enc = enc
+
+		// Encoding must be recorded
+		if cw.meta == nil {
+			cw.meta = new(CacheMeta)
+		}
+	}
+
+	return cw, nil
+}
+
+// CacheWriter writes content of a CacheEntry, keeping track of its size,
+// line count and hash for the metadata.
+type CacheWriter struct {
+	entry     *CacheEntry
+	w         StorageWriter
+	enc       io.WriteCloser
+	encoding  string
+	mtime     time.Time
+	meta      *CacheMeta
+	size      int64
+	lineCount int
+	hash      hash.Hash
+	done      bool
+
+	// Called with the entry locked on Commit, as the content may have
+	// changed while writing
+	check func() error
+}
+
+func (w *CacheWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, ErrCacheWriterDone
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if w.enc != nil {
+		n, err = w.enc.Write(p)
 	} else {
-		return true, nil
+		n, err = w.w.Write(p)
+	}
+
+	w.size += int64(n)
+	if w.lineCount != -1 {
+		w.lineCount += dat.Count(p[:n])
+	}
+	if w.hash != nil {
+		w.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+func (w *CacheWriter) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if w.enc != nil {
+		if err := w.enc.Close(); err != nil {
+			w.w.Abort()
+			return err
+		}
+	}
+
+	w.entry.Lock()
+	defer w.entry.cache.evictIfExceeded()
+	defer w.entry.Unlock()
+
+	if w.check != nil {
+		if err := w.check(); err != nil {
+			w.w.Abort()
+			return err
+		}
+	}
+
+	if err := w.w.Commit(); err != nil {
+		return err
+	}
+
+	if fileInfo, err := w.entry.cache.Storage.Stat(w.entry.Key); err == nil {
+		w.entry.cache.usage.setContent(w.entry.Key, fileInfo.Size())
+	}
+
+	if w.meta == nil {
+		return w.entry.putMeta(nil, 0, 0, nil, w.mtime)
+	}
+
+	if w.lineCount == -1 || w.hash == nil {
+		content, err := w.entry.openContentAs(w.encoding, w.size)
+		if err != nil {
+			return err
+		}
+		w.lineCount, w.hash, err = digestContent(content)
+		content.Close()
+		if err != nil {
+			return err
+		}
 	}
+
+	w.meta.Encoding = w.encoding
+
+	return w.entry.putMeta(w.meta, w.size, w.lineCount, w.hash, w.mtime)
+}
+
+func (w *CacheWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	debugf(w.entry, "Aborting write")
+
+	return w.w.Abort()
+}
+
+// digestContent counts lines of r and computes its hash.
+func digestContent(r io.Reader) (int, hash.Hash, error) {
+	h := newContentHash()
+	lineCount, err := dat.CountPosts(io.TeeReader(r, h))
+	return lineCount, h, err
 }
 
+// UpdateMeta modifies the metadata of existing content by update.
+func (cacheEntry *CacheEntry) UpdateMeta(update func(*CacheMeta)) error {
+	cacheEntry.Lock()
+	defer cacheEntry.Unlock()
+
+	content, err := cacheEntry.openContent()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	meta, err := cacheEntry.getMeta()
+	if err != nil {
+		return err
+	}
+
+	lineCount := -1
+	var h hash.Hash
+	if meta == nil {
+		meta = &CacheMeta{Encoding: content.Encoding}
+	} else if meta.Size == content.Size() {
+		lineCount = meta.LineCount
+		h = restoreContentHash(meta.HashState)
+	}
+
+	if lineCount == -1 || h == nil {
+		lineCount, h, err = digestContent(io.NewSectionReader(content, 0, content.Size()))
+		if err != nil {
+			return err
+		}
+	}
+
+	update(meta)
+
+	return cacheEntry.putMeta(meta, content.Size(), lineCount, h, content.ModTime)
+}
+
+// MarkArchived records that the thread is dat落ち, and compresses it in
+// background if Cache.ArchivedCompression is set.
+func (cacheEntry *CacheEntry) MarkArchived() error {
+	err := cacheEntry.UpdateMeta(func(meta *CacheMeta) {
+		meta.StatusCode = http.StatusNonAuthoritativeInfo
+		if !meta.Archived {
+			meta.Archived = true
+			meta.ArchivedAt = time.Now()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if encoding := cacheEntry.cache.ArchivedCompression; encoding != "" {
+		cacheEntry.recompressInBackground(encoding)
+	}
+
+	return nil
+}
+
+// recompressInBackground runs Recompress unless one is already running for
+// the entry.
+func (cacheEntry *CacheEntry) recompressInBackground(encoding string) {
+	if !cacheEntry.cache.recompressing.add(cacheEntry.Key) {
+		return
+	}
+
+	go func() {
+		defer cacheEntry.cache.recompressing.remove(cacheEntry.Key)
+
+		if err := cacheEntry.Recompress(encoding); err != nil {
+			warningf(cacheEntry, "Recompressing: %s", err)
+		}
+	}()
+}
+
+// Recompress rewrites the content in encoding at rest, keeping its mtime
+// and meta.
+func (cacheEntry *CacheEntry) Recompress(encoding string) error {
+	cacheEntry.RLock()
+
+	fileInfo, err := cacheEntry.cache.Storage.Stat(cacheEntry.Key)
+	if err != nil {
+		cacheEntry.RUnlock()
+		return err
+	}
+
+	content, err := cacheEntry.openContent()
+	if err != nil {
+		cacheEntry.RUnlock()
+		return err
+	}
+	defer content.Close()
+
+	meta, err := cacheEntry.getMeta()
+	cacheEntry.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if content.Encoding == encoding {
+		return nil
+	}
+
+	infof(cacheEntry, "Recompressing %q -> %q", content.Encoding, encoding)
+
+	w, err := cacheEntry.cache.Storage.Create(cacheEntry.Key, content.ModTime)
+	if err != nil {
+		return err
+	}
+
+	cw, err := cacheEntry.newWriter(w, encoding, content.ModTime, meta, 0, 0, newContentHash())
+	if err != nil {
+		return err
+	}
+
+	cw.check = func() error {
+		current, err := cacheEntry.cache.Storage.Stat(cacheEntry.Key)
+		if err != nil {
+			return err
+		}
+		if current.Size() != fileInfo.Size() || !current.ModTime().Equal(fileInfo.ModTime()) {
+			return ErrCacheChanged
+		}
+		return nil
+	}
+
+	if _, err := io.Copy(cw, content); err != nil {
+		cw.Abort()
+		return err
+	}
+
+	return cw.Commit()
+}
+
+// putMeta stores meta for the content just written. Must be called with
+// the entry locked.
+func (cacheEntry *CacheEntry) putMeta(meta *CacheMeta, size int64, lineCount int, h hash.Hash, mtime time.Time) error {
+	if meta == nil {
+		// Stale metadata would be worse than none
+		if err := cacheEntry.cache.Storage.Delete(metaKey(cacheEntry.Key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	meta.Size = size
+	meta.LineCount = lineCount
+	meta.LastModified = mtime
+	meta.setContentHash(h)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	debugf(cacheEntry, "Writing meta")
+
+	return cacheEntry.cache.Storage.Put(metaKey(cacheEntry.Key), data, mtime)
+}
+
+// Delete deletes the content and its meta. Snapshots are kept so that the
+// content can be recovered; see DeleteVersions.
 func (cacheEntry *CacheEntry) Delete() error {
 	cacheEntry.Lock()
 	defer cacheEntry.Unlock()
-	return os.Remove(cacheEntry.FilePath)
+
+	if err := cacheEntry.cache.Storage.Delete(metaKey(cacheEntry.Key)); err != nil && !os.IsNotExist(err) {
+		warningf(cacheEntry, "Deleting meta: %s", err)
+	}
+	if fileInfo, err := cacheEntry.cache.Storage.Stat(previousKey(cacheEntry.Key)); err == nil {
+		if err := cacheEntry.cache.Storage.Delete(previousKey(cacheEntry.Key)); err != nil {
+			warningf(cacheEntry, "Deleting previous content: %s", err)
+		} else {
+			cacheEntry.cache.usage.addSidecar(cacheEntry.Key, -fileInfo.Size())
+		}
+	}
+
+	cacheEntry.cache.accessed.forget(cacheEntry.Key)
+	cacheEntry.cache.usage.deleteContent(cacheEntry.Key)
+
+	return cacheEntry.cache.Storage.Delete(cacheEntry.Key)
 }
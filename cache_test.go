@@ -3,9 +3,13 @@ package etch_test
 import (
 	. "github.com/motemen/etch"
 	. "github.com/smartystreets/goconvey/convey"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,7 +23,7 @@ func TestCache(t *testing.T) {
 
 		t.Log("Cache root: ", tmpDir)
 
-		cache := &Cache{tmpDir}
+		cache := NewCache(tmpDir)
 
 		url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
 		if err != nil {
@@ -27,7 +31,7 @@ func TestCache(t *testing.T) {
 		}
 
 		Convey("UrlToFilePath(url)", func() {
-			So(cache.UrlToFilePath(url), ShouldEqual, tmpDir+"/toro.2ch.net/book/dat/1363665368.dat")
+			So(cache.UrlToFilePath(url), ShouldEqual, tmpDir+"/http/toro.2ch.net/book/dat/1363665368.dat")
 		})
 	})
 }
@@ -45,13 +49,13 @@ func TestCacheEntry(t *testing.T) {
 
 	t.Log("Cache root: ", tmpDir)
 
-	cache := &Cache{tmpDir}
+	cache := NewCache(tmpDir)
 
 	Convey("A nonexistent CacheEntry", t, func() {
 		entry := cache.GetEntry(url)
 
 		Convey("FilePath", func() {
-			So(entry.FilePath, ShouldEqual, tmpDir+"/toro.2ch.net/book/dat/1363665368.dat")
+			So(entry.FilePath, ShouldEqual, tmpDir+"/http/toro.2ch.net/book/dat/1363665368.dat")
 		})
 
 		Convey("GetContent() returns error", func() {
@@ -89,3 +93,402 @@ func TestCacheEntry(t *testing.T) {
 		})
 	})
 }
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewMemoryCache()
+
+	url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	Convey("A CacheEntry on memory", t, func() {
+		entry := cache.GetEntry(url)
+
+		Convey("FreshenContent(content, mtime) and GetContent()", func() {
+			updated, err := entry.FreshenContent(([]byte)("foobar"), time.Now())
+			So(updated, ShouldBeTrue)
+			So(err, ShouldBeNil)
+
+			content, _, err := cache.GetEntry(url).GetContent()
+			So(content, ShouldResemble, []byte("foobar"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Keys()", func() {
+			keys := cache.Keys()
+			So(len(keys), ShouldEqual, 1)
+			So(keys[0].String(), ShouldEqual, url.String())
+		})
+	})
+}
+
+func TestCacheMeta(t *testing.T) {
+	url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	Convey("A CacheEntry with meta", t, func() {
+		cache := NewMemoryCache()
+		entry := cache.GetEntry(url)
+
+		meta, err := entry.GetMeta()
+		So(meta, ShouldBeNil)
+		So(err, ShouldBeNil)
+
+		mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+		updated, err := entry.FreshenContentWithMeta(
+			[]byte("1<>\n2<>\n"), mtime, &CacheMeta{ETag: `"abc"`, ContentType: "text/plain", StatusCode: 200},
+		)
+		So(updated, ShouldBeTrue)
+		So(err, ShouldBeNil)
+
+		Convey("GetMeta() returns stored meta with counts", func() {
+			meta, err := entry.GetMeta()
+			So(err, ShouldBeNil)
+			So(meta.ETag, ShouldEqual, `"abc"`)
+			So(meta.ContentType, ShouldEqual, "text/plain")
+			So(meta.StatusCode, ShouldEqual, 200)
+			So(meta.Size, ShouldEqual, 8)
+			So(meta.LineCount, ShouldEqual, 2)
+			So(meta.LastModified.Equal(mtime), ShouldBeTrue)
+		})
+
+		Convey("Keys() does not list meta", func() {
+			So(len(cache.Keys()), ShouldEqual, 1)
+		})
+
+		Convey("Meta does not collide with a URL which looks like it", func() {
+			metaLike, _ := url.Parse(url.String() + ".meta")
+			_, err := cache.GetEntry(metaLike).FreshenContent([]byte("meta<>\n"), mtime)
+			So(err, ShouldBeNil)
+
+			So(len(cache.Keys()), ShouldEqual, 2)
+
+			meta, err := entry.GetMeta()
+			So(err, ShouldBeNil)
+			So(meta.ETag, ShouldEqual, `"abc"`)
+
+			content, _, err := cache.GetEntry(metaLike).GetContent()
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "meta<>\n")
+		})
+
+		Convey("Delete() removes meta too", func() {
+			So(entry.Delete(), ShouldBeNil)
+
+			meta, err := entry.GetMeta()
+			So(meta, ShouldBeNil)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+// exclusiveStorage fails the test when a write overlaps with any other
+// access to the same key
+type exclusiveStorage struct {
+	Storage
+	t       *testing.T
+	readers int32
+	writers int32
+}
+
+func (s *exclusiveStorage) write(f func() error) error {
+	if atomic.AddInt32(&s.writers, 1) != 1 || atomic.LoadInt32(&s.readers) != 0 {
+		s.t.Error("write overlapped with other access")
+	}
+	defer atomic.AddInt32(&s.writers, -1)
+	time.Sleep(time.Millisecond)
+	return f()
+}
+
+func (s *exclusiveStorage) read(f func() error) error {
+	atomic.AddInt32(&s.readers, 1)
+	if atomic.LoadInt32(&s.writers) != 0 {
+		s.t.Error("read overlapped with write")
+	}
+	defer atomic.AddInt32(&s.readers, -1)
+	time.Sleep(time.Millisecond)
+	return f()
+}
+
+func (s *exclusiveStorage) Get(key string) (content []byte, err error) {
+	s.read(func() error { content, err = s.Storage.Get(key); return err })
+	return
+}
+
+// Open counts as a read until the reader is closed
+func (s *exclusiveStorage) Open(key string) (StorageReader, error) {
+	atomic.AddInt32(&s.readers, 1)
+	if atomic.LoadInt32(&s.writers) != 0 {
+		s.t.Error("read overlapped with write")
+	}
+	time.Sleep(time.Millisecond)
+
+	r, err := s.Storage.Open(key)
+	if err != nil {
+		atomic.AddInt32(&s.readers, -1)
+		return nil, err
+	}
+	return &exclusiveReader{StorageReader: r, s: s}, nil
+}
+
+func (s *exclusiveStorage) Stat(key string) (fileInfo os.FileInfo, err error) {
+	s.read(func() error { fileInfo, err = s.Storage.Stat(key); return err })
+	return
+}
+
+func (s *exclusiveStorage) Create(key string, mtime time.Time) (StorageWriter, error) {
+	w, err := s.Storage.Create(key, mtime)
+	if err != nil {
+		return nil, err
+	}
+	return &exclusiveWriter{StorageWriter: w, s: s}, nil
+}
+
+func (s *exclusiveStorage) OpenAppend(key string, mtime time.Time) (StorageWriter, error) {
+	w, err := s.Storage.OpenAppend(key, mtime)
+	if err != nil {
+		return nil, err
+	}
+	return &exclusiveWriter{StorageWriter: w, s: s}, nil
+}
+
+func (s *exclusiveStorage) Put(key string, content []byte, mtime time.Time) error {
+	return s.write(func() error { return s.Storage.Put(key, content, mtime) })
+}
+
+func (s *exclusiveStorage) Delete(key string) error {
+	return s.write(func() error { return s.Storage.Delete(key) })
+}
+
+type exclusiveReader struct {
+	StorageReader
+	s    *exclusiveStorage
+	once sync.Once
+}
+
+func (r *exclusiveReader) Close() error {
+	r.once.Do(func() { atomic.AddInt32(&r.s.readers, -1) })
+	return r.StorageReader.Close()
+}
+
+// exclusiveWriter writes to the storage on Commit; written content is not
+// visible until then
+type exclusiveWriter struct {
+	StorageWriter
+	s *exclusiveStorage
+}
+
+func (w *exclusiveWriter) Commit() error {
+	return w.s.write(w.StorageWriter.Commit)
+}
+
+func TestCacheEntryLocking(t *testing.T) {
+	cache := &Cache{Storage: &exclusiveStorage{Storage: NewMemoryStorage(), t: t}}
+
+	url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			cache.GetEntry(url).FreshenContent([]byte("foobar"), time.Now())
+		}()
+		go func() {
+			defer wg.Done()
+			cache.GetEntry(url).GetContent()
+		}()
+		go func() {
+			defer wg.Done()
+			cache.GetEntry(url).Delete()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheEntryAppend(t *testing.T) {
+	url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	Convey("A CacheEntry with content", t, func() {
+		cache := NewMemoryCache()
+		entry := cache.GetEntry(url)
+
+		mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+		entry.FreshenContentWithMeta([]byte("1<>\n"), mtime, &CacheMeta{})
+
+		Convey("AppendContentWithMeta() at the end", func() {
+			updated, err := entry.AppendContentWithMeta([]byte("2<>\n3<>\n"), 4, mtime.Add(time.Hour), &CacheMeta{})
+			So(updated, ShouldBeTrue)
+			So(err, ShouldBeNil)
+
+			content, mtime2, _ := entry.GetContent()
+			So(string(content), ShouldEqual, "1<>\n2<>\n3<>\n")
+			So(mtime2.Equal(mtime.Add(time.Hour)), ShouldBeTrue)
+
+			meta, _ := entry.GetMeta()
+			So(meta.Size, ShouldEqual, 12)
+			So(meta.LineCount, ShouldEqual, 3)
+
+			sum := sha256.Sum256([]byte("1<>\n2<>\n3<>\n"))
+			So(meta.Hash, ShouldEqual, hex.EncodeToString(sum[:]))
+		})
+
+		Convey("AppendContentWithMeta() at wrong offset", func() {
+			updated, err := entry.AppendContentWithMeta([]byte("2<>\n"), 3, mtime.Add(time.Hour), &CacheMeta{})
+			So(updated, ShouldBeFalse)
+			So(err, ShouldEqual, ErrCacheSizeMismatch)
+
+			content, _, _ := entry.GetContent()
+			So(string(content), ShouldEqual, "1<>\n")
+		})
+
+		Convey("AppendContent() does not block readers while writing", func() {
+			w, err := entry.AppendContent(4, mtime.Add(time.Hour), &CacheMeta{})
+			So(err, ShouldBeNil)
+			w.Write([]byte("2<>\n"))
+
+			content, _, err := entry.GetContent()
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "1<>\n")
+
+			So(w.Commit(), ShouldBeNil)
+
+			content, _, _ = entry.GetContent()
+			So(string(content), ShouldEqual, "1<>\n2<>\n")
+
+			meta, _ := entry.GetMeta()
+			So(meta.LineCount, ShouldEqual, 2)
+		})
+
+		Convey("AppendContent() fails on Commit if the content changed meanwhile", func() {
+			w, err := entry.AppendContent(4, mtime.Add(time.Hour), &CacheMeta{})
+			So(err, ShouldBeNil)
+			w.Write([]byte("2<>\n"))
+
+			entry.FreshenContentWithMeta([]byte("1<>\nX<>\n"), mtime.Add(time.Hour), &CacheMeta{})
+
+			So(w.Commit(), ShouldEqual, ErrCacheSizeMismatch)
+
+			content, _, _ := entry.GetContent()
+			So(string(content), ShouldEqual, "1<>\nX<>\n")
+		})
+
+		Convey("CreateContent() fails on Commit if newer content is committed meanwhile", func() {
+			w, err := entry.CreateContent(mtime.Add(time.Hour), &CacheMeta{})
+			So(err, ShouldBeNil)
+			w.Write([]byte("old<>\n"))
+
+			entry.FreshenContentWithMeta([]byte("new<>\n"), mtime.Add(2*time.Hour), &CacheMeta{})
+
+			So(w.Commit(), ShouldEqual, ErrCacheNotFresh)
+
+			content, _, _ := entry.GetContent()
+			So(string(content), ShouldEqual, "new<>\n")
+		})
+	})
+}
+
+func TestCacheEntryPrevious(t *testing.T) {
+	url, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	Convey("A CacheEntry with previous version", t, func() {
+		cache := NewMemoryCache()
+		entry := cache.GetEntry(url)
+
+		mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+		entry.FreshenContentWithMeta([]byte("1<>\n2<>\n3<>\n"), mtime, &CacheMeta{})
+		So(entry.Supersede(), ShouldBeNil)
+
+		_, _, err := entry.GetContent()
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		Convey("DiffPrevious() lists rewritten lines", func() {
+			entry.FreshenContentWithMeta([]byte("1<>\nあぼーん\n3<>\n4<>\n"), mtime.Add(time.Hour), &CacheMeta{})
+
+			diff, err := entry.DiffPrevious()
+			So(err, ShouldBeNil)
+			So(diff.Changed, ShouldResemble, []int{2})
+			So(diff.Removed, ShouldBeEmpty)
+			So(cache.Keys(), ShouldHaveLength, 1)
+		})
+
+		Convey("DiffPrevious() lists removed lines", func() {
+			entry.FreshenContentWithMeta([]byte("1<>\n"), mtime.Add(time.Hour), &CacheMeta{})
+
+			diff, err := entry.DiffPrevious()
+			So(err, ShouldBeNil)
+			So(diff.Changed, ShouldBeEmpty)
+			So(diff.Removed, ShouldResemble, []int{2, 3})
+		})
+
+		Convey("DiffPrevious() works without snapshots", func() {
+			cache.MaxVersions = 0
+
+			entry.FreshenContentWithMeta([]byte("1<>\n2<>\n"), mtime.Add(time.Hour), &CacheMeta{})
+			So(entry.SavePrevious(), ShouldBeNil)
+			entry.FreshenContentWithMeta([]byte("1<>\nあぼーん\n"), mtime.Add(2*time.Hour), &CacheMeta{})
+
+			diff, err := entry.DiffPrevious()
+			So(err, ShouldBeNil)
+			So(diff.Changed, ShouldResemble, []int{2})
+
+			versions, err := entry.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 1)
+		})
+
+		Convey("Keeps up to MaxVersions snapshots", func() {
+			cache.MaxVersions = 2
+
+			for _, content := range []string{"1<>\n", "1<>\n2<>\n"} {
+				entry.FreshenContentWithMeta([]byte(content), mtime.Add(time.Hour), &CacheMeta{})
+				So(entry.Supersede(), ShouldBeNil)
+			}
+
+			versions, err := entry.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 2)
+			So(versions[1].Size, ShouldEqual, 8)
+
+			content, err := entry.OpenVersion(versions[0].ID)
+			So(err, ShouldBeNil)
+			defer content.Close()
+
+			data, _ := ioutil.ReadAll(content)
+			So(string(data), ShouldEqual, "1<>\n")
+
+			_, err = entry.OpenVersion("../1363665368.dat")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Delete() keeps snapshots, which are deleted by DeleteVersions()", func() {
+			entry.FreshenContentWithMeta([]byte("1<>\n"), mtime.Add(time.Hour), &CacheMeta{})
+			So(entry.Delete(), ShouldBeNil)
+
+			_, err := entry.DiffPrevious()
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			versions, err := entry.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 1)
+
+			So(entry.DeleteVersions(), ShouldBeNil)
+
+			versions, err = entry.Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldBeEmpty)
+		})
+	})
+}
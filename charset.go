@@ -0,0 +1,108 @@
+package etch
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Names of the charset of 2ch, in lower case
+var shiftJISNames = map[string]bool{
+	"shift_jis":   true,
+	"sjis":        true,
+	"x-sjis":      true,
+	"cp932":       true,
+	"windows-31j": true,
+}
+
+// decodeShiftJIS decodes text of 2ch, which is in CP932. Bytes not
+// decodable are replaced with U+FFFD.
+func decodeShiftJIS(b []byte) string {
+	decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(decoded)
+}
+
+// wantsUTF8 reports whether req asks for the content transcoded to UTF-8,
+// by the "encoding" parameter, or else by Accept-Charset.
+func wantsUTF8(req *http.Request) (bool, error) {
+	encoding := strings.ToLower(req.URL.Query().Get("encoding"))
+	switch {
+	case encoding == "":
+		return prefersUTF8(req.Header.Get("Accept-Charset")), nil
+	case encoding == "utf-8" || encoding == "utf8":
+		return true, nil
+	case shiftJISNames[encoding]:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// prefersUTF8 reports whether Accept-Charset acceptCharset prefers UTF-8 to
+// the original charset. Ties are resolved to the original.
+func prefersUTF8(acceptCharset string) bool {
+	utf8Q, sjisQ, anyQ := -1.0, -1.0, -1.0
+
+	for _, part := range strings.Split(acceptCharset, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				q, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+
+		switch {
+		case name == "utf-8":
+			utf8Q = q
+		case shiftJISNames[name]:
+			if q > sjisQ {
+				sjisQ = q
+			}
+		case name == "*":
+			anyQ = q
+		}
+	}
+
+	if utf8Q < 0 {
+		utf8Q = anyQ
+	}
+	if sjisQ < 0 {
+		sjisQ = anyQ
+	}
+
+	return utf8Q > 0 && utf8Q > sjisQ
+}
+
+// transcodeToUTF8 returns r decoded from CP932, modifying header for it.
+// Content which is declared to be in UTF-8 already is returned as is.
+func transcodeToUTF8(header http.Header, r io.Reader) io.Reader {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.EqualFold(params["charset"], "utf-8") {
+		return r
+	}
+
+	params["charset"] = "utf-8"
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		header.Set("ETag", strings.TrimSuffix(etag, `"`)+`-utf8"`)
+	}
+
+	return transform.NewReader(r, japanese.ShiftJIS.NewDecoder())
+}
@@ -0,0 +1,357 @@
+package etch
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCoalesceTimeout  = errors.New("timed out waiting for ongoing request")
+	ErrCoalesceCanceled = errors.New("canceled waiting for ongoing request")
+	ErrCoalesceAborted  = errors.New("ongoing request aborted")
+)
+
+// Coalescer lets concurrent requests for the same key share one upstream
+// fetch, in the manner of singleflight. The first request for a key becomes
+// the leader and others wait for its result.
+type Coalescer struct {
+	// How long waiters wait for the leader; zero means forever
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	stats CoalescerStats
+}
+
+// CoalescerStats counts requests by how they were handled.
+type CoalescerStats struct {
+	Leaders   int64 `json:"leaders"`   // sent to upstream
+	Coalesced int64 `json:"coalesced"` // got the result of a leader
+	Failed    int64 `json:"failed"`    // got an error of a leader
+	TimedOut  int64 `json:"timedOut"`
+	Canceled  int64 `json:"canceled"`
+	Waiting   int64 `json:"waiting"` // currently waiting
+}
+
+type coalescedCall struct {
+	key  string
+	once sync.Once
+	done chan struct{}
+	resp *http.Response
+	err  error
+
+	// Guarded by Coalescer.mu
+	waiters  int
+	resolved bool
+	copies   []*http.Response
+}
+
+// takeCopy returns a copy of the response for a waiter. Must be called
+// with Coalescer.mu locked.
+func (call *coalescedCall) takeCopy() *http.Response {
+	if len(call.copies) == 0 {
+		return nil
+	}
+
+	resp := call.copies[0]
+	call.copies = call.copies[1:]
+	return resp
+}
+
+func NewCoalescer(timeout time.Duration) *Coalescer {
+	return &Coalescer{Timeout: timeout, calls: make(map[string]*coalescedCall)}
+}
+
+// Join returns the ongoing call for key, and whether the caller has become
+// its leader. The leader must call Done eventually.
+func (c *Coalescer) Join(key string) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+
+	call := &coalescedCall{key: key, done: make(chan struct{})}
+	c.calls[key] = call
+	atomic.AddInt64(&c.stats.Leaders, 1)
+
+	return call, true
+}
+
+// Wait waits for the result of call until Timeout passes or cancel is
+// closed. The response returned is a copy of the leader's, with its own
+// body reader.
+func (c *Coalescer) Wait(call *coalescedCall, cancel <-chan struct{}) (*http.Response, error) {
+	atomic.AddInt64(&c.stats.Waiting, 1)
+	defer atomic.AddInt64(&c.stats.Waiting, -1)
+
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timer := time.NewTimer(c.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-call.done:
+		if call.err != nil || call.resp == nil {
+			atomic.AddInt64(&c.stats.Failed, 1)
+			if call.err == nil {
+				return nil, ErrCoalesceAborted
+			}
+			return nil, call.err
+		}
+		atomic.AddInt64(&c.stats.Coalesced, 1)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return call.takeCopy(), nil
+
+	case <-timeout:
+		atomic.AddInt64(&c.stats.TimedOut, 1)
+		c.leave(call)
+		return nil, ErrCoalesceTimeout
+
+	case <-cancel:
+		atomic.AddInt64(&c.stats.Canceled, 1)
+		c.leave(call)
+		return nil, ErrCoalesceCanceled
+	}
+}
+
+// leave gives up waiting for call, releasing the copy of the response
+// prepared if it is already done.
+func (c *Coalescer) leave(call *coalescedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !call.resolved {
+		call.waiters--
+	} else if resp := call.takeCopy(); resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+}
+
+// Done records the result of call and releases its waiters. Only the first
+// call of Done for a call takes effect. If there are waiters, the body of
+// resp is replaced so that it can be read by each of them independently.
+func (c *Coalescer) Done(call *coalescedCall, resp *http.Response, err error) {
+	call.once.Do(func() {
+		c.mu.Lock()
+		if c.calls[call.key] == call {
+			delete(c.calls, call.key)
+		}
+
+		call.resp = resp
+		call.err = err
+		call.resolved = true
+
+		if resp != nil && call.waiters > 0 {
+			var body *sharedBody
+			if resp.Body != nil {
+				body = newSharedBody(resp.Body, call.waiters+1)
+				resp.Body = body.newReader()
+			}
+
+			call.copies = make([]*http.Response, call.waiters)
+			for i := range call.copies {
+				call.copies[i] = copyResponse(resp, nil)
+				if body != nil {
+					call.copies[i].Body = body.newReader()
+				}
+			}
+		}
+		c.mu.Unlock()
+
+		close(call.done)
+	})
+}
+
+func (c *Coalescer) Stats() CoalescerStats {
+	return CoalescerStats{
+		Leaders:   atomic.LoadInt64(&c.stats.Leaders),
+		Coalesced: atomic.LoadInt64(&c.stats.Coalesced),
+		Failed:    atomic.LoadInt64(&c.stats.Failed),
+		TimedOut:  atomic.LoadInt64(&c.stats.TimedOut),
+		Canceled:  atomic.LoadInt64(&c.stats.Canceled),
+		Waiting:   atomic.LoadInt64(&c.stats.Waiting),
+	}
+}
+
+// copyResponse returns a copy of resp with body, which can be modified
+// without affecting resp.
+func copyResponse(resp *http.Response, body io.ReadCloser) *http.Response {
+	copied := *resp
+	copied.Header = resp.Header.Clone()
+	copied.Body = body
+	return &copied
+}
+
+// sharedBody lets readers read the same body independently, buffering what
+// is read so far by some but not all of the readers. The body is read by
+// whichever reader needs more, and is closed when all of the readers are
+// closed.
+type sharedBody struct {
+	src    io.ReadCloser
+	readMu sync.Mutex
+
+	mu   sync.Mutex
+	buf  []byte
+	base int   // offset of buf in the body
+	offs []int // of each reader; -1 if closed
+	err  error
+	refs int
+
+	// Closed along with src, eg. the upstream body detached from goproxy
+	owned io.Closer
+}
+
+func newSharedBody(src io.ReadCloser, refs int) *sharedBody {
+	return &sharedBody{src: src, refs: refs}
+}
+
+// own makes closer closed when all of the readers are closed.
+func (b *sharedBody) own(closer io.Closer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.owned = closer
+}
+
+func (b *sharedBody) newReader() *sharedBodyReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.offs = append(b.offs, 0)
+	return &sharedBodyReader{body: b, id: len(b.offs) - 1}
+}
+
+func (b *sharedBody) read(id int, p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if off := b.offs[id]; off < b.base+len(b.buf) {
+			n := copy(p, b.buf[off-b.base:])
+			b.offs[id] += n
+			b.trim()
+			b.mu.Unlock()
+			return n, nil
+		}
+		err := b.err
+		b.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+
+		b.fill()
+	}
+}
+
+// trim drops the buffer read by all of the readers. Must be called with mu
+// locked.
+func (b *sharedBody) trim() {
+	start := b.base + len(b.buf)
+	for _, off := range b.offs {
+		if off != -1 && off < start {
+			start = off
+		}
+	}
+
+	// Dropped part is freed when append reallocates buf
+	b.buf = b.buf[start-b.base:]
+	b.base = start
+}
+
+func (b *sharedBody) fill() {
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+
+	b.mu.Lock()
+	err := b.err
+	b.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	chunk := make([]byte, 32*1024)
+	n, err := b.src.Read(chunk)
+
+	b.mu.Lock()
+	b.buf = append(b.buf, chunk[:n]...)
+	b.err = err
+	b.mu.Unlock()
+}
+
+func (b *sharedBody) release(id int) error {
+	b.mu.Lock()
+	b.offs[id] = -1
+	b.trim()
+	b.refs--
+	refs := b.refs
+	owned := b.owned
+	b.mu.Unlock()
+
+	if refs == 0 {
+		// Wait for the ongoing read if any
+		b.readMu.Lock()
+		defer b.readMu.Unlock()
+
+		err := b.src.Close()
+		if owned != nil {
+			owned.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+type sharedBodyReader struct {
+	body   *sharedBody
+	id     int
+	closed bool
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return r.body.read(r.id, p)
+}
+
+func (r *sharedBodyReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.body.release(r.id)
+}
+
+// detachableBody is the upstream body handed to goproxy, which closes it
+// when the client has gone away. Once detached, its Close does nothing, and
+// the body is to be closed by whoever detached it.
+type detachableBody struct {
+	io.ReadCloser
+	detached int32
+}
+
+func (b *detachableBody) Close() error {
+	if atomic.LoadInt32(&b.detached) == 1 {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// detach returns the Closer which actually closes the body.
+func (b *detachableBody) detach() io.Closer {
+	atomic.StoreInt32(&b.detached, 1)
+	return b.ReadCloser
+}
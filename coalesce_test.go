@@ -0,0 +1,146 @@
+package etch_test
+
+import (
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestCoalescer(t *testing.T) {
+	Convey("A Coalescer", t, func() {
+		coalescer := NewCoalescer(0)
+
+		leaderCall, leader := coalescer.Join("http://example.com/")
+		So(leader, ShouldBeTrue)
+
+		waiterCall, leader := coalescer.Join("http://example.com/")
+		So(leader, ShouldBeFalse)
+
+		Convey("Passes copies of the response of the leader to waiters", func() {
+			body := &closeRecorder{Reader: strings.NewReader("foo\nbar\n")}
+			resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}, Body: body}
+			coalescer.Done(leaderCall, resp, nil)
+
+			got, err := coalescer.Wait(waiterCall, nil)
+			So(err, ShouldBeNil)
+			So(got, ShouldNotPointTo, resp)
+			So(got.StatusCode, ShouldEqual, 200)
+
+			got.Header.Set("Content-Encoding", "gzip")
+			So(resp.Header.Get("Content-Encoding"), ShouldEqual, "")
+
+			// Bodies are read at their own pace
+			gotHead := make([]byte, 4)
+			_, err = io.ReadFull(got.Body, gotHead)
+			So(err, ShouldBeNil)
+			So(string(gotHead), ShouldEqual, "foo\n")
+
+			leaderContent, _ := ioutil.ReadAll(resp.Body)
+			So(string(leaderContent), ShouldEqual, "foo\nbar\n")
+
+			gotContent, _ := ioutil.ReadAll(got.Body)
+			So(string(gotContent), ShouldEqual, "bar\n")
+
+			resp.Body.Close()
+			So(body.closed, ShouldBeFalse)
+			got.Body.Close()
+			So(body.closed, ShouldBeTrue)
+
+			_, leader := coalescer.Join("http://example.com/")
+			So(leader, ShouldBeTrue)
+
+			So(coalescer.Stats().Leaders, ShouldEqual, 2)
+			So(coalescer.Stats().Coalesced, ShouldEqual, 1)
+		})
+
+		Convey("Lets long bodies be read far apart", func() {
+			content := strings.Repeat("0123456789abcdef", 10*1024)
+			resp := &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(content))}
+			coalescer.Done(leaderCall, resp, nil)
+
+			got, err := coalescer.Wait(waiterCall, nil)
+			So(err, ShouldBeNil)
+
+			gotHead := make([]byte, 50000)
+			_, err = io.ReadFull(got.Body, gotHead)
+			So(err, ShouldBeNil)
+
+			leaderHead := make([]byte, 100)
+			_, err = io.ReadFull(resp.Body, leaderHead)
+			So(err, ShouldBeNil)
+
+			got.Body.Close()
+
+			leaderRest, _ := ioutil.ReadAll(resp.Body)
+			So(string(leaderHead)+string(leaderRest), ShouldEqual, content)
+		})
+
+		Convey("Lets waiters read after the leader closes early", func() {
+			content := strings.Repeat("0123456789abcdef", 10*1024)
+			body := &closeRecorder{Reader: strings.NewReader(content)}
+			resp := &http.Response{StatusCode: 200, Body: body}
+			coalescer.Done(leaderCall, resp, nil)
+
+			got, err := coalescer.Wait(waiterCall, nil)
+			So(err, ShouldBeNil)
+
+			leaderHead := make([]byte, 1000)
+			_, err = io.ReadFull(resp.Body, leaderHead)
+			So(err, ShouldBeNil)
+
+			resp.Body.Close()
+			So(body.closed, ShouldBeFalse)
+
+			gotContent, err := ioutil.ReadAll(got.Body)
+			So(err, ShouldBeNil)
+			So(string(gotContent), ShouldEqual, content)
+
+			got.Body.Close()
+			So(body.closed, ShouldBeTrue)
+		})
+
+		Convey("Passes the error of the leader to waiters", func() {
+			upstreamErr := errors.New("connection refused")
+			coalescer.Done(leaderCall, nil, upstreamErr)
+			coalescer.Done(leaderCall, &http.Response{StatusCode: 200}, nil)
+
+			_, err := coalescer.Wait(waiterCall, nil)
+			So(err, ShouldEqual, upstreamErr)
+			So(coalescer.Stats().Failed, ShouldEqual, 1)
+		})
+
+		Convey("Times out waiting", func() {
+			coalescer.Timeout = 10 * time.Millisecond
+
+			_, err := coalescer.Wait(waiterCall, nil)
+			So(err, ShouldEqual, ErrCoalesceTimeout)
+			So(coalescer.Stats().TimedOut, ShouldEqual, 1)
+			So(coalescer.Stats().Waiting, ShouldEqual, 0)
+		})
+
+		Convey("Stops waiting when canceled", func() {
+			cancel := make(chan struct{})
+			close(cancel)
+
+			_, err := coalescer.Wait(waiterCall, cancel)
+			So(err, ShouldEqual, ErrCoalesceCanceled)
+			So(coalescer.Stats().Canceled, ShouldEqual, 1)
+		})
+	})
+}
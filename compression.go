@@ -0,0 +1,308 @@
+package etch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encodings of content at rest. Both gzip and zstd allow concatenating
+// compressed streams, so compressed content can still be appended to.
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+type codec struct {
+	magic     []byte
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var codecs = map[string]*codec{
+	EncodingGzip: {
+		magic: []byte{0x1f, 0x8b},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	EncodingZstd: {
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+func ParseEncoding(s string) (string, error) {
+	switch s {
+	case "", "none", "identity":
+		return EncodingIdentity, nil
+	case EncodingGzip, EncodingZstd:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown encoding: %q", s)
+	}
+}
+
+// ParseHostEncodings parses "host=encoding,..." specification.
+func ParseHostEncodings(s string) (map[string]string, error) {
+	hostEncodings := make(map[string]string)
+	if s == "" {
+		return hostEncodings, nil
+	}
+
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid host encoding: %q", spec)
+		}
+
+		encoding, err := ParseEncoding(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		hostEncodings[parts[0]] = encoding
+	}
+
+	return hostEncodings, nil
+}
+
+// sniffEncoding guesses the encoding of content stored without meta.
+// dat files never start with these magic bytes.
+func sniffEncoding(r io.ReaderAt) string {
+	head := make([]byte, 4)
+	n, _ := r.ReadAt(head, 0)
+
+	for encoding, codec := range codecs {
+		if bytes.HasPrefix(head[:n], codec.magic) {
+			return encoding
+		}
+	}
+
+	return EncodingIdentity
+}
+
+// encodingFor returns the encoding at rest for newly written content of u.
+func (cache *Cache) encodingFor(u *url.URL, archived bool) string {
+	if archived && cache.ArchivedCompression != "" {
+		return cache.ArchivedCompression
+	}
+
+	suffixes := make([]string, 0, len(cache.HostCompression))
+	for suffix := range cache.HostCompression {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	if suffix, ok := longestHostSuffix(u.Hostname(), suffixes); ok {
+		return cache.HostCompression[suffix]
+	}
+
+	return cache.Compression
+}
+
+// longestHostSuffix returns the longest of suffixes which host is or is a
+// subdomain of, so that more specific specifications take precedence.
+func longestHostSuffix(host string, suffixes []string) (string, bool) {
+	longest, found := "", false
+	for _, suffix := range suffixes {
+		if host != suffix && !strings.HasSuffix(host, "."+suffix) {
+			continue
+		}
+		if !found || len(suffix) > len(longest) {
+			longest, found = suffix, true
+		}
+	}
+
+	return longest, found
+}
+
+// compressedReaderAt provides random access to compressed content by
+// decompressing from the start. Sequential reads, which are the most
+// common, continue from the last position. The first read elsewhere
+// decompresses to the end keeping the tail, so that looking for the overlap
+// near the end does not start over each time.
+type compressedReaderAt struct {
+	sync.Mutex
+	open    func() (io.ReadCloser, error)
+	r       io.ReadCloser
+	pos     int64
+	tail    []byte
+	tailOff int64
+}
+
+// minCompressedTail is the least size of the tail kept, which covers the
+// first chunk overlapStart reads looking for the last line.
+const minCompressedTail = 4096 + 1
+
+func (ra *compressedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	ra.Lock()
+	defer ra.Unlock()
+
+	if ra.tail == nil && off != ra.pos {
+		if err := ra.readTail(); err != nil {
+			return 0, err
+		}
+	}
+
+	if ra.tail != nil && off >= ra.tailOff {
+		if off-ra.tailOff >= int64(len(ra.tail)) {
+			return 0, io.EOF
+		}
+
+		n := copy(p, ra.tail[off-ra.tailOff:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	if ra.r == nil || off < ra.pos {
+		if ra.r != nil {
+			ra.r.Close()
+		}
+
+		r, err := ra.open()
+		if err != nil {
+			ra.r = nil
+			return 0, err
+		}
+
+		ra.r = r
+		ra.pos = 0
+	}
+
+	if off > ra.pos {
+		skipped, err := io.CopyN(ioutil.Discard, ra.r, off-ra.pos)
+		ra.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(ra.r, p)
+	ra.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// readTail decompresses the content to the end, keeping the last line and
+// at least minCompressedTail bytes of it.
+func (ra *compressedReaderAt) readTail() error {
+	if ra.r != nil && ra.pos != 0 {
+		ra.r.Close()
+		ra.r = nil
+	}
+
+	if ra.r == nil {
+		r, err := ra.open()
+		if err != nil {
+			return err
+		}
+
+		ra.r = r
+		ra.pos = 0
+	}
+
+	tail := make([]byte, 0, 2*minCompressedTail)
+	tailOff := int64(0)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ra.r.Read(buf)
+		tail = append(tail, buf[:n]...)
+		ra.pos += int64(n)
+
+		if cut := len(tail) - minCompressedTail; cut > 0 {
+			// The last line starts after the line feed preceding the last
+			// byte
+			if lineStart := bytes.LastIndexByte(tail[:len(tail)-1], '\n') + 1; lineStart < cut {
+				cut = lineStart
+			}
+			tail = tail[:copy(tail, tail[cut:])]
+			tailOff += int64(cut)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ra.r.Close()
+			ra.r = nil
+			return err
+		}
+	}
+
+	ra.tail = tail
+	ra.tailOff = tailOff
+	return nil
+}
+
+// size returns the size of the decompressed content, which is known after
+// readTail.
+func (ra *compressedReaderAt) size() int64 {
+	return ra.tailOff + int64(len(ra.tail))
+}
+
+func (ra *compressedReaderAt) Close() error {
+	ra.Lock()
+	defer ra.Unlock()
+
+	if ra.r == nil {
+		return nil
+	}
+
+	err := ra.r.Close()
+	ra.r = nil
+	return err
+}
+
+// keySet is a set of keys safe for concurrent use.
+type keySet struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+// add adds key to the set, and reports whether it was not in the set.
+func (set *keySet) add(key string) bool {
+	set.Lock()
+	defer set.Unlock()
+
+	if set.keys[key] {
+		return false
+	}
+
+	if set.keys == nil {
+		set.keys = make(map[string]bool)
+	}
+	set.keys[key] = true
+	return true
+}
+
+func (set *keySet) remove(key string) {
+	set.Lock()
+	defer set.Unlock()
+
+	delete(set.keys, key)
+}
@@ -0,0 +1,208 @@
+package etch_test
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readCountingStorage counts bytes read from the storage
+type readCountingStorage struct {
+	Storage
+	read int64
+}
+
+func (storage *readCountingStorage) Open(key string) (StorageReader, error) {
+	r, err := storage.Storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingReader{StorageReader: r, storage: storage}, nil
+}
+
+type readCountingReader struct {
+	StorageReader
+	storage *readCountingStorage
+}
+
+func (r *readCountingReader) Read(p []byte) (int, error) {
+	n, err := r.StorageReader.Read(p)
+	atomic.AddInt64(&r.storage.read, int64(n))
+	return n, err
+}
+
+func (r *readCountingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.StorageReader.ReadAt(p, off)
+	atomic.AddInt64(&r.storage.read, int64(n))
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	u, err := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	if err != nil {
+		t.Fatal("Pargins URL failed: ", err)
+	}
+
+	mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+
+	for encoding, magic := range map[string][]byte{
+		EncodingGzip: {0x1f, 0x8b},
+		EncodingZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	} {
+		Convey("A cache compressed with "+encoding, t, func() {
+			storage := NewMemoryStorage()
+			cache := &Cache{Storage: storage, Compression: encoding}
+			entry := cache.GetEntry(u)
+
+			_, err := entry.FreshenContent([]byte("1<>\n2<>\n"), mtime)
+			So(err, ShouldBeNil)
+
+			Convey("Stores compressed content", func() {
+				raw, _ := storage.Get(cache.UrlToKey(u))
+				So(bytes.HasPrefix(raw, magic), ShouldBeTrue)
+
+				meta, _ := entry.GetMeta()
+				So(meta.Encoding, ShouldEqual, encoding)
+				So(meta.Size, ShouldEqual, 8)
+				So(meta.LineCount, ShouldEqual, 2)
+			})
+
+			Convey("Reads decompressed content", func() {
+				content, _, err := entry.GetContent()
+				So(err, ShouldBeNil)
+				So(string(content), ShouldEqual, "1<>\n2<>\n")
+
+				cc, err := entry.OpenContent()
+				So(err, ShouldBeNil)
+				defer cc.Close()
+
+				So(cc.Size(), ShouldEqual, 8)
+
+				last := make([]byte, 1)
+				_, err = cc.ReadAt(last, cc.Size()-1)
+				So(err, ShouldBeNil)
+				So(string(last), ShouldEqual, "\n")
+
+				all, err := ioutil.ReadAll(cc)
+				So(err, ShouldBeNil)
+				So(string(all), ShouldEqual, "1<>\n2<>\n")
+			})
+
+			Convey("Reads near the end without decompressing again", func() {
+				var buf bytes.Buffer
+				for i := 1; i <= 1000; i++ {
+					fmt.Fprintf(&buf, "Name<>sage<>2013/01/01<>Post %d<>\n", i)
+				}
+				_, err := entry.FreshenContent(buf.Bytes(), mtime.Add(time.Hour))
+				So(err, ShouldBeNil)
+
+				counting := &readCountingStorage{Storage: storage}
+				cache.Storage = counting
+
+				cc, err := entry.OpenContent()
+				So(err, ShouldBeNil)
+				defer cc.Close()
+
+				// As looking for the overlap from the end
+				for _, size := range []int64{4096, 1, 100} {
+					p := make([]byte, size)
+					_, err := cc.ReadAt(p, cc.Size()-size)
+					So(err, ShouldBeNil)
+					So(string(p), ShouldEqual, buf.String()[buf.Len()-int(size):])
+				}
+
+				raw, _ := storage.Get(cache.UrlToKey(u))
+				So(atomic.LoadInt64(&counting.read), ShouldBeLessThanOrEqualTo, len(raw))
+
+				all, err := ioutil.ReadAll(cc)
+				So(err, ShouldBeNil)
+				So(string(all), ShouldEqual, buf.String())
+			})
+
+			Convey("Appends in the same encoding", func() {
+				cache.Compression = EncodingIdentity
+
+				_, err := entry.AppendContentWithMeta([]byte("3<>\n"), 8, mtime.Add(time.Hour), &CacheMeta{})
+				So(err, ShouldBeNil)
+
+				content, _, err := entry.GetContent()
+				So(err, ShouldBeNil)
+				So(string(content), ShouldEqual, "1<>\n2<>\n3<>\n")
+
+				meta, _ := entry.GetMeta()
+				So(meta.Encoding, ShouldEqual, encoding)
+				So(meta.Size, ShouldEqual, 12)
+				So(meta.LineCount, ShouldEqual, 3)
+			})
+		})
+	}
+
+	Convey("HostCompression applies the longest matching host suffix", t, func() {
+		storage := NewMemoryStorage()
+		cache := &Cache{Storage: storage, HostCompression: map[string]string{
+			"2ch.net":      EncodingGzip,
+			"toro.2ch.net": EncodingZstd,
+		}}
+
+		_, err := cache.GetEntry(u).FreshenContent([]byte("1<>\n"), mtime)
+		So(err, ShouldBeNil)
+
+		raw, _ := storage.Get(cache.UrlToKey(u))
+		So(bytes.HasPrefix(raw, []byte{0x28, 0xb5, 0x2f, 0xfd}), ShouldBeTrue)
+
+		other, _ := url.Parse("http://hayabusa.2ch.net/book/dat/1363665368.dat")
+		_, err = cache.GetEntry(other).FreshenContent([]byte("1<>\n"), mtime)
+		So(err, ShouldBeNil)
+
+		raw, _ = storage.Get(cache.UrlToKey(other))
+		So(bytes.HasPrefix(raw, []byte{0x1f, 0x8b}), ShouldBeTrue)
+
+		ipv6, _ := url.Parse("http://[::1]:8080/book/dat/1363665368.dat")
+		cache.HostCompression["::1"] = EncodingGzip
+		_, err = cache.GetEntry(ipv6).FreshenContent([]byte("1<>\n"), mtime)
+		So(err, ShouldBeNil)
+
+		raw, _ = storage.Get(cache.UrlToKey(ipv6))
+		So(bytes.HasPrefix(raw, []byte{0x1f, 0x8b}), ShouldBeTrue)
+	})
+
+	Convey("ArchivedCompression compresses archived entries", t, func() {
+		storage := NewMemoryStorage()
+		cache := &Cache{Storage: storage, ArchivedCompression: EncodingGzip}
+		entry := cache.GetEntry(u)
+
+		entry.FreshenContent([]byte("1<>\n2<>\n"), mtime)
+
+		raw, _ := storage.Get(cache.UrlToKey(u))
+		So(string(raw), ShouldEqual, "1<>\n2<>\n")
+
+		So(entry.MarkArchived(), ShouldBeNil)
+
+		meta, _ := entry.GetMeta()
+		So(meta.Archived, ShouldBeTrue)
+
+		// Compressed in background
+		for i := 0; i < 100; i++ {
+			if raw, _ = storage.Get(cache.UrlToKey(u)); bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(bytes.HasPrefix(raw, []byte{0x1f, 0x8b}), ShouldBeTrue)
+
+		content, mtime2, err := entry.GetContent()
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "1<>\n2<>\n")
+		So(mtime2.Equal(mtime), ShouldBeTrue)
+
+		meta, _ = entry.GetMeta()
+		So(meta.Archived, ShouldBeTrue)
+		So(meta.Encoding, ShouldEqual, EncodingGzip)
+	})
+}
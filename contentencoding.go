@@ -0,0 +1,119 @@
+package etch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, spec := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(spec, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		return q > 0
+	}
+
+	return false
+}
+
+// addVary adds field to Vary header unless it is already there.
+func addVary(header http.Header, field string) {
+	for _, value := range header["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", field)
+}
+
+func isIdentityEncoding(contentEncoding string) bool {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+	return contentEncoding == "" || contentEncoding == "identity"
+}
+
+func isGzipEncoding(contentEncoding string) bool {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+	return contentEncoding == "gzip" || contentEncoding == "x-gzip"
+}
+
+// decodeGzipResponse replaces the body of gzip-encoded resp with decoded one.
+func decodeGzipResponse(resp *http.Response) error {
+	gzReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = &multiReadCloser{Reader: gzReader, multiCloser: multiCloser{gzReader, resp.Body}}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// gzipReader reads body compressing with gzip. Compressed data is flushed
+// for every read from the body so that clients receive content in a
+// streaming fashion.
+type gzipReader struct {
+	body io.ReadCloser
+	buf  bytes.Buffer
+	gw   *gzip.Writer
+	p    []byte
+	err  error
+}
+
+func newGzipReader(body io.ReadCloser) *gzipReader {
+	r := &gzipReader{body: body, p: make([]byte, 32*1024)}
+	r.gw = gzip.NewWriter(&r.buf)
+	return r
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && r.err == nil {
+		n, err := r.body.Read(r.p)
+		if n > 0 {
+			r.gw.Write(r.p[:n])
+		}
+
+		if err == io.EOF {
+			r.gw.Close()
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+		} else if n > 0 {
+			r.gw.Flush()
+		}
+	}
+
+	if r.buf.Len() > 0 {
+		return r.buf.Read(p)
+	}
+
+	return 0, r.err
+}
+
+func (r *gzipReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,141 @@
+package etch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// contentRange represents the value of Content-Range header of a single
+// part response. Total is -1 if unknown.
+type contentRange struct {
+	Start, End, Total int64
+}
+
+func parseContentRange(s string) (*contentRange, error) {
+	const prefix = "bytes "
+
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+
+	parts := strings.SplitN(s[len(prefix):], "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+
+	cr := &contentRange{Total: -1}
+
+	var err error
+	if cr.Start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || cr.Start < 0 {
+		return nil, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+	if cr.End, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || cr.End < cr.Start {
+		return nil, fmt.Errorf("invalid Content-Range: %q", s)
+	}
+	if parts[1] != "*" {
+		if cr.Total, err = strconv.ParseInt(parts[1], 10, 64); err != nil || cr.Total <= cr.End {
+			return nil, fmt.Errorf("invalid Content-Range: %q", s)
+		}
+	}
+
+	return cr, nil
+}
+
+// checkPartialResponse validates that resp is a response to the request
+// for range "bytes=<start>-", that is, it contains a single range from start
+// to the end of the content.
+func checkPartialResponse(resp *http.Response, start int64) error {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "multipart/byteranges" {
+		return fmt.Errorf("unexpected multipart/byteranges response")
+	}
+
+	s := resp.Header.Get("Content-Range")
+	if s == "" {
+		return fmt.Errorf("missing Content-Range")
+	}
+
+	cr, err := parseContentRange(s)
+	if err != nil {
+		return err
+	}
+
+	if cr.Start != start {
+		return fmt.Errorf("unexpected start offset %d (expected %d)", cr.Start, start)
+	}
+
+	if cr.Total != -1 && cr.End != cr.Total-1 {
+		return fmt.Errorf("range %d-%d does not reach the end of content (%d bytes)", cr.Start, cr.End, cr.Total)
+	}
+
+	if resp.ContentLength != -1 && resp.ContentLength != cr.End-cr.Start+1 {
+		return fmt.Errorf("Content-Length %d does not match range %d-%d", resp.ContentLength, cr.Start, cr.End)
+	}
+
+	return nil
+}
+
+// OverlapLastLine is a special value of ProxyServer.OverlapWindow, which
+// makes the last full line of the cache requested again.
+const OverlapLastLine = -1
+
+// ParseOverlapWindow parses a number of bytes or "line".
+func ParseOverlapWindow(s string) (int, error) {
+	if s == "line" {
+		return OverlapLastLine, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid overlap window: %q", s)
+	}
+
+	return n, nil
+}
+
+// overlapStart returns the offset from which the content of size is
+// requested again, to check that the response continues it.
+func overlapStart(r io.ReaderAt, size int64, window int) (int64, error) {
+	if window != OverlapLastLine {
+		if window < 1 {
+			window = 1
+		}
+		if start := size - int64(window); start > 0 {
+			return start, nil
+		}
+		return 0, nil
+	}
+
+	// Search backwards for the line feed preceding the last line, which
+	// ends at size-1
+	buf := make([]byte, 4096)
+	end := size - 1
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		n, err := r.ReadAt(buf[:end-start], start)
+		if err != nil && !(err == io.EOF && int64(n) == end-start) {
+			return 0, err
+		}
+
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i != -1 {
+			return start + int64(i) + 1, nil
+		}
+
+		end = start
+	}
+
+	return 0, nil
+}
@@ -1,9 +1,13 @@
 package etch
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 )
 
 type ControlServer struct {
@@ -41,21 +45,51 @@ func (control *ControlServer) Setup() {
 			return
 		}
 
+		transcode, err := wantsUTF8(req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.URL.Query().Get("encoding") == "" {
+			rw.Header().Add("Vary", "Accept-Charset")
+		}
+
 		cacheEntry := control.Proxy.Cache.GetEntry(u)
-		content, mtime, err := cacheEntry.GetContent()
+
+		if version := req.URL.Query().Get("version"); version != "" {
+			control.serveVersion(rw, req, cacheEntry, version, transcode)
+			return
+		}
+
+		content, err := cacheEntry.OpenContent()
 
 		if os.IsNotExist(err) {
 			rw.WriteHeader(http.StatusNotFound)
 			return
+		} else if err != nil {
+			errorf(control, "Opening cache %s: %s", cacheEntry, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		defer content.Close()
+
+		meta, err := cacheEntry.GetMeta()
+		if err != nil {
+			warningf(control, "Reading cache meta %s: %s", cacheEntry, err)
 		}
 
 		switch req.Method {
-		case "HEAD":
-			rw.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+		case "HEAD", "GET":
+			setCacheHeaders(rw.Header(), content, meta)
 
-		case "GET":
-			rw.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
-			rw.Write(content)
+			var body io.Reader = content
+			if transcode {
+				body = transcodeToUTF8(rw.Header(), content)
+			}
+			if req.Method == "GET" {
+				io.Copy(rw, body)
+			}
 
 		case "DELETE":
 			if err := cacheEntry.Delete(); err != nil {
@@ -73,6 +107,134 @@ func (control *ControlServer) Setup() {
 		}
 	})
 
+	control.HandleFunc("/cache/versions", func(rw http.ResponseWriter, req *http.Request) {
+		urlString := req.URL.Query().Get("url")
+		if urlString == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(urlString)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		cacheEntry := control.Proxy.Cache.GetEntry(u)
+
+		switch req.Method {
+		case "GET":
+			versions, err := cacheEntry.Versions()
+			if err != nil {
+				errorf(control, "Reading versions %s: %s", cacheEntry, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(versions)
+
+		case "DELETE":
+			if err := cacheEntry.DeleteVersions(); err != nil {
+				errorf(control, "Deleting versions %s: %s", cacheEntry, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			rw.WriteHeader(http.StatusNoContent)
+
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	control.HandleFunc("/stats", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"coalescer": control.Proxy.Coalescer.Stats(),
+		})
+	})
+
+	control.HandleFunc("/watch", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(control.Proxy.Watcher.Threads())
+			return
+		}
+
+		urlString := req.URL.Query().Get("url")
+		if urlString == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u, err := url.Parse(urlString)
+		if err != nil || !u.IsAbs() {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case "POST":
+			if control.Proxy.Watcher.Watch(u) {
+				rw.WriteHeader(http.StatusCreated)
+			} else {
+				rw.WriteHeader(http.StatusNoContent)
+			}
+
+		case "DELETE":
+			if control.Proxy.Watcher.Unwatch(u) {
+				rw.WriteHeader(http.StatusNoContent)
+			} else {
+				rw.WriteHeader(http.StatusNotFound)
+			}
+
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	control.HandleFunc("/boards", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(control.Proxy.Cache.Boards())
+	})
+
+	// /boards/{host}/{board}/threads
+	control.HandleFunc("/boards/", func(rw http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/boards/"), "/")
+		if len(parts) != 3 || parts[2] != "threads" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		cacheEntry, err := control.Proxy.Cache.BoardEntry(parts[0], parts[1])
+		if os.IsNotExist(err) {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		subjects, err := cacheEntry.Subjects()
+		if os.IsNotExist(err) {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			errorf(control, "Reading subject.txt %s: %s", cacheEntry, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(subjects)
+	})
+
+	control.HandleFunc("/queue", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"hosts":    control.Proxy.Limiter.Stats(),
+			"requests": control.Proxy.Limiter.Queue(),
+		})
+	})
+
 	control.HandleFunc("/events", func(rw http.ResponseWriter, req *http.Request) {
 		ch := control.Proxy.Listeners.Create()
 		defer control.Proxy.Listeners.Remove(ch)
@@ -91,3 +253,56 @@ func (control *ControlServer) Setup() {
 		}
 	})
 }
+
+func (control *ControlServer) serveVersion(rw http.ResponseWriter, req *http.Request, cacheEntry *CacheEntry, version string, transcode bool) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	content, err := cacheEntry.OpenVersion(version)
+	if os.IsNotExist(err) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		errorf(control, "Opening version %s of %s: %s", version, cacheEntry, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer content.Close()
+
+	rw.Header().Set("Content-Type", "text/plain")
+	setCacheHeaders(rw.Header(), content, nil)
+	rw.Header().Set("X-Etch-Version", version)
+
+	var body io.Reader = content
+	if transcode {
+		body = transcodeToUTF8(rw.Header(), content)
+	}
+	if req.Method == "GET" {
+		io.Copy(rw, body)
+	}
+}
+
+func setCacheHeaders(header http.Header, content *CacheContent, meta *CacheMeta) {
+	header.Set("Last-Modified", content.ModTime.UTC().Format(http.TimeFormat))
+	header.Set("Content-Length", fmt.Sprint(content.Size()))
+
+	if meta == nil {
+		return
+	}
+
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	if meta.ETag != "" {
+		header.Set("ETag", meta.ETag)
+	}
+	if meta.StatusCode == http.StatusNonAuthoritativeInfo {
+		header.Set("X-Original-Status-Code", fmt.Sprint(meta.StatusCode))
+	}
+	if meta.Archived {
+		header.Set("X-Etch-Archived", "1")
+	}
+}
@@ -0,0 +1,199 @@
+// Package dat parses dat files of 2ch-compatible BBS's, in which each line
+// is a post of the form "name<>mail<>date ID:xxx BE:xxx<>body<>title",
+// encoded in CP932. Only the first post has the title of the thread.
+package dat
+
+import (
+	"bufio"
+	"bytes"
+	"golang.org/x/text/encoding/japanese"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const separator = "<>"
+
+var newline = []byte("\n")
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+type Post struct {
+	// 1-origin line number
+	Number int
+	Name   string
+	Mail   string
+	// Date, ID and BE as is, eg. "2013/03/19(火) 12:34:56.78 ID:abcdEFGH0"
+	Meta string
+	// Zero if not parseable, eg. of あぼーん
+	Date time.Time
+	ID   string
+	BE   string
+	// HTML fragment with <br> for line breaks
+	Body  string
+	Title string
+	// Whether the line does not have the fields expected
+	Malformed bool
+}
+
+type Thread struct {
+	Title string
+	Posts []*Post
+}
+
+var (
+	datePattern = regexp.MustCompile(`(\d{2,4})/(\d{1,2})/(\d{1,2})(?:\([^)]*\))?\s*(\d{1,2}):(\d{1,2})(?::(\d{1,2})(?:\.(\d{1,3}))?)?`)
+	idPattern   = regexp.MustCompile(`ID:(\S+)`)
+	bePattern   = regexp.MustCompile(`BE:(\S+)`)
+)
+
+// ParsePost parses line, which may or may not end with a newline, as the
+// post of number. Malformed lines are parsed as much as possible, with the
+// whole line as the body if not separated at all.
+func ParsePost(number int, line []byte) *Post {
+	line = bytes.TrimRight(line, "\r\n")
+
+	decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(line)
+	if err != nil {
+		decoded = line
+	}
+
+	post := &Post{Number: number}
+
+	fields := strings.Split(string(decoded), separator)
+	if len(fields) < 4 {
+		post.Malformed = true
+		post.Body = fields[len(fields)-1]
+		if len(fields) > 1 {
+			post.Name = fields[0]
+		}
+		return post
+	}
+
+	post.Name = fields[0]
+	post.Mail = fields[1]
+	post.Meta = fields[2]
+	post.Body = strings.TrimSpace(fields[3])
+	if len(fields) > 4 {
+		post.Title = fields[4]
+	}
+	if len(fields) > 5 {
+		post.Malformed = true
+	}
+
+	post.Date = parseDate(post.Meta)
+	if m := idPattern.FindStringSubmatch(post.Meta); m != nil {
+		post.ID = m[1]
+	}
+	if m := bePattern.FindStringSubmatch(post.Meta); m != nil {
+		post.BE = m[1]
+	}
+
+	return post
+}
+
+func parseDate(meta string) time.Time {
+	m := datePattern.FindStringSubmatch(meta)
+	if m == nil {
+		return time.Time{}
+	}
+
+	n := make([]int, len(m))
+	for i, s := range m[1:] {
+		n[i+1], _ = strconv.Atoi(s)
+	}
+
+	year := n[1]
+	if year < 100 {
+		year += 2000
+	}
+
+	nsec := 0
+	if m[7] != "" {
+		frac := m[7] + strings.Repeat("0", 3-len(m[7]))
+		msec, _ := strconv.Atoi(frac)
+		nsec = msec * int(time.Millisecond)
+	}
+
+	return time.Date(year, time.Month(n[2]), n[3], n[4], n[5], n[6], nsec, jst)
+}
+
+// Reader reads posts from a dat. Posts are lines terminated by a newline;
+// a last line without one is not read, as the dat may be being written and
+// the post is yet to be complete.
+type Reader struct {
+	r *bufio.Reader
+	n int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next post, or io.EOF if there are no more.
+func (r *Reader) Read() (*Post, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	r.n++
+	return ParsePost(r.n, line), nil
+}
+
+// Skip skips the next post without parsing it, or returns io.EOF if there
+// are no more.
+func (r *Reader) Skip() error {
+	for {
+		_, err := r.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		r.n++
+		return nil
+	}
+}
+
+func ParseThread(r io.Reader) (*Thread, error) {
+	thread := &Thread{Posts: make([]*Post, 0)}
+
+	reader := NewReader(r)
+	for {
+		post, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if post.Number == 1 {
+			thread.Title = post.Title
+		}
+		thread.Posts = append(thread.Posts, post)
+	}
+
+	return thread, nil
+}
+
+// Count returns the number of newlines in p, which is the number of posts
+// completed by appending p to a dat.
+func Count(p []byte) int {
+	return bytes.Count(p, newline)
+}
+
+// CountPosts returns the number of posts in r as read by Reader.
+func CountPosts(r io.Reader) (int, error) {
+	reader := NewReader(r)
+	for {
+		if err := reader.Skip(); err == io.EOF {
+			return reader.n, nil
+		} else if err != nil {
+			return reader.n, err
+		}
+	}
+}
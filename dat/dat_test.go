@@ -0,0 +1,90 @@
+package dat_test
+
+import (
+	. "github.com/motemen/etch/dat"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/text/encoding/japanese"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sjis(s string) string {
+	encoded, err := japanese.ShiftJIS.NewEncoder().String(s)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+func TestParsePost(t *testing.T) {
+	Convey("ParsePost parses fields", t, func() {
+		post := ParsePost(1, []byte(sjis("名無しさん<>sage<>2013/03/19(火) 12:34:56.78 ID:abcdEFGH0 BE:12345-2BP(1000)<> 本文<br>二行目 <>スレタイ\n")))
+
+		So(post.Number, ShouldEqual, 1)
+		So(post.Name, ShouldEqual, "名無しさん")
+		So(post.Mail, ShouldEqual, "sage")
+		So(post.Date.Equal(time.Date(2013, 3, 19, 3, 34, 56, 780*int(time.Millisecond), time.UTC)), ShouldBeTrue)
+		So(post.ID, ShouldEqual, "abcdEFGH0")
+		So(post.BE, ShouldEqual, "12345-2BP(1000)")
+		So(post.Body, ShouldEqual, "本文<br>二行目")
+		So(post.Title, ShouldEqual, "スレタイ")
+		So(post.Malformed, ShouldBeFalse)
+	})
+
+	Convey("ParsePost handles old and deleted posts", t, func() {
+		post := ParsePost(2, []byte("name<><>02/01/01 00:00<>body<>"))
+		So(post.Date.Year(), ShouldEqual, 2002)
+		So(post.ID, ShouldEqual, "")
+		So(post.Malformed, ShouldBeFalse)
+
+		post = ParsePost(3, []byte(sjis("あぼーん<>あぼーん<>あぼーん<>あぼーん<>")))
+		So(post.Date.IsZero(), ShouldBeTrue)
+		So(post.Body, ShouldEqual, "あぼーん")
+	})
+
+	Convey("ParsePost does not fail on malformed lines", t, func() {
+		post := ParsePost(4, []byte("garbage\r\n"))
+		So(post.Malformed, ShouldBeTrue)
+		So(post.Body, ShouldEqual, "garbage")
+
+		post = ParsePost(5, []byte("a<>b<>c<>d<>e<>f"))
+		So(post.Malformed, ShouldBeTrue)
+		So(post.Body, ShouldEqual, "d")
+
+		post = ParsePost(6, []byte("\xff\xfe<><><>\x81"))
+		So(post.Number, ShouldEqual, 6)
+	})
+}
+
+func TestParseThread(t *testing.T) {
+	Convey("ParseThread parses all of the posts", t, func() {
+		content := sjis("1<><>2013/03/19(火) 12:34:56.78 ID:a<>first<>タイトル\n2<><>2013/03/19(火) 12:35:00.00 ID:b<>second<>\n3<><>2013/03/19(火) 12:3")
+
+		thread, err := ParseThread(strings.NewReader(content))
+		So(err, ShouldBeNil)
+		So(thread.Title, ShouldEqual, "タイトル")
+		So(thread.Posts, ShouldHaveLength, 2)
+		So(thread.Posts[1].Number, ShouldEqual, 2)
+		So(thread.Posts[1].Body, ShouldEqual, "second")
+
+		Convey("as many as CountPosts counts, without the incomplete line", func() {
+			count, err := CountPosts(strings.NewReader(content))
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(thread.Posts))
+			So(Count([]byte(content)), ShouldEqual, count)
+		})
+	})
+
+	Convey("CountPosts counts long lines as one", t, func() {
+		count, err := CountPosts(strings.NewReader(strings.Repeat("x", 10000) + "\n"))
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, 1)
+	})
+
+	Convey("Reader reads nothing from empty dat", t, func() {
+		_, err := NewReader(strings.NewReader("")).Read()
+		So(err, ShouldEqual, io.EOF)
+	})
+}
@@ -0,0 +1,49 @@
+package etch
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// LineDiff lists 1-origin line numbers, that is, post numbers of a dat,
+// which differ between two versions of content. Lines appended to the
+// newer one are not included.
+type LineDiff struct {
+	Changed []int
+	Removed []int
+}
+
+func (diff *LineDiff) Empty() bool {
+	return len(diff.Changed) == 0 && len(diff.Removed) == 0
+}
+
+func diffLines(older, newer io.Reader) (*LineDiff, error) {
+	diff := &LineDiff{Changed: []int{}, Removed: []int{}}
+
+	olderReader := bufio.NewReader(older)
+	newerReader := bufio.NewReader(newer)
+
+	for n := 1; ; n++ {
+		olderLine, err := olderReader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(olderLine) == 0 {
+			break
+		}
+
+		newerLine, err := newerReader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(newerLine) == 0 {
+			diff.Removed = append(diff.Removed, n)
+		} else if !bytes.Equal(olderLine, newerLine) {
+			diff.Changed = append(diff.Changed, n)
+		}
+	}
+
+	return diff, nil
+}
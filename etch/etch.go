@@ -2,23 +2,132 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/motemen/etch"
 	"os"
 	"strings"
+	"time"
 )
 
 func main() {
 	cacheDir := flag.String("cache-dir", "cache", "cache directory")
 	port := flag.Int("port", 25252, "proxy port")
 	hosts := flag.String("host", "2ch.net,bbspink.com", "hosts to proxy")
+	migrateCache := flag.Bool("migrate-cache", false, "migrate cache directory of older layout and exit")
+	cacheMaxSize := flag.Int64("cache-max-size", 0, "maximum total bytes of cache (0 for unlimited)")
+	cacheMaxEntries := flag.Int("cache-max-entries", 0, "maximum number of cache entries (0 for unlimited)")
+	cacheEviction := flag.String("cache-eviction", "lru", "cache eviction policy (lru, oldest)")
+	keepArchived := flag.Bool("keep-archived", false, "never evict dat落ち threads")
+	compression := flag.String("compression", "none", "encoding of cache at rest (none, gzip, zstd)")
+	hostCompression := flag.String("host-compression", "", "encoding of cache at rest by host (host=encoding,...)")
+	archivedCompression := flag.String("archived-compression", "none", "encoding of dat落ち threads at rest (none, gzip, zstd)")
+	hostAlias := flag.String("host-alias", "", "mirror hosts cached as the canonical ones (mirror=host,...)")
+	cacheVersions := flag.Int("cache-versions", 1, "number of snapshots kept for each thread replaced non-incrementally")
+	overlap := flag.String("overlap", "line", "bytes of cache to re-request for checking deltas, or \"line\" for the last line")
+	coalesceTimeout := flag.Duration("coalesce-timeout", 30*time.Second, "how long requests wait for an ongoing request for the same URL (0 for forever)")
+	serveStale := flag.Bool("serve-stale", false, "serve cache when upstream fails or times out")
+	upstreamTimeout := flag.Duration("upstream-timeout", 0, "how long to wait for upstream revalidating cache (0 for forever)")
+	offline := flag.Bool("offline", false, "serve only from cache, never contacting upstream")
+	freshFor := flag.Duration("fresh-for", 0, "how long cache is served without contacting upstream after checked")
+	hostFreshFor := flag.String("host-fresh-for", "", "-fresh-for by host (host=duration,...)")
+	rateLimit := flag.Float64("rate-limit", 0, "requests per second to each upstream host (0 for unlimited)")
+	rateBurst := flag.Int("rate-burst", 1, "requests to each upstream host allowed in a burst")
+	maxConns := flag.Int("max-conns", 0, "maximum concurrent requests to each upstream host (0 for unlimited)")
+	watchMinInterval := flag.Duration("watch-min-interval", time.Minute, "minimum interval of checking watched threads")
+	watchMaxInterval := flag.Duration("watch-max-interval", time.Hour, "maximum interval of checking watched threads")
+	cacheSweepInterval := flag.Duration("cache-sweep-interval", 10*time.Minute, "interval of background cache eviction")
 
 	flag.Parse()
 
 	etch.ConfigureLoggers()
 
+	if *migrateCache {
+		migrated, err := etch.NewCache(*cacheDir).MigrateLegacyKeys()
+		fmt.Fprintf(os.Stderr, "Migrated %d files\n", migrated)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	evictionPolicy, err := etch.ParseEvictionPolicy(*cacheEviction)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	encoding, err := etch.ParseEncoding(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	hostEncodings, err := etch.ParseHostEncodings(*hostCompression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	archivedEncoding, err := etch.ParseEncoding(*archivedCompression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	hostAliases, err := etch.ParseHostAliases(*hostAlias)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	hostFreshDurations, err := etch.ParseHostDurations(*hostFreshFor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	overlapWindow, err := etch.ParseOverlapWindow(*overlap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	etchServer := etch.NewServer(*cacheDir, strings.Split(*hosts, ","))
 
-	err := etchServer.ListenAndServe(*port)
+	cache := etchServer.ProxyServer.Cache
+	cache.MaxSize = *cacheMaxSize
+	cache.MaxEntries = *cacheMaxEntries
+	cache.EvictionPolicy = evictionPolicy
+	cache.Compression = encoding
+	cache.HostCompression = hostEncodings
+	cache.ArchivedCompression = archivedEncoding
+	cache.MaxVersions = *cacheVersions
+	cache.Normalizer = (&etch.UrlNormalizer{HostAliases: hostAliases}).Normalize
+	if *keepArchived {
+		cache.ArchivedRetention = etch.RetainForever
+	}
+
+	etchServer.ProxyServer.OverlapWindow = overlapWindow
+	etchServer.ProxyServer.Coalescer.Timeout = *coalesceTimeout
+	etchServer.ProxyServer.ServeStale = *serveStale
+	etchServer.ProxyServer.UpstreamTimeout = *upstreamTimeout
+	etchServer.ProxyServer.Offline = *offline
+	etchServer.ProxyServer.FreshFor = *freshFor
+	etchServer.ProxyServer.Limiter.Rate = *rateLimit
+	etchServer.ProxyServer.Limiter.Burst = *rateBurst
+	etchServer.ProxyServer.Limiter.MaxConcurrent = *maxConns
+	etchServer.ProxyServer.HostFreshFor = hostFreshDurations
+
+	etchServer.ProxyServer.Watcher.MinInterval = *watchMinInterval
+	etchServer.ProxyServer.Watcher.MaxInterval = *watchMaxInterval
+	etchServer.ProxyServer.Watcher.Start()
+
+	if *cacheMaxSize > 0 || *cacheMaxEntries > 0 {
+		cache.StartSweeper(*cacheSweepInterval)
+	}
+
+	err = etchServer.ListenAndServe(*port)
 	if err != nil {
 		os.Exit(1);
 	}
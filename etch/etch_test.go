@@ -3,11 +3,22 @@ package main_test
 import (
 	. "github.com/motemen/etch"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/text/encoding/japanese"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -27,12 +38,226 @@ func (h OKHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Range") == "" {
 		w.Write([]byte(ContentAtFirst))
 	} else {
+		content := ContentAtFirst + ContentDelta
+		start := requestedRangeStart(r)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
 		w.WriteHeader(206)
-		w.Write([]byte(ContentAtFirst[len(ContentAtFirst)-1:]))
-		w.Write([]byte(ContentDelta))
+		w.Write([]byte(content[start:]))
 	}
 }
 
+// requestedRangeStart returns N of "Range: bytes=N-"
+func requestedRangeStart(r *http.Request) int {
+	var start int
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+	return start
+}
+
+// MalformedRangeHandler serves the content growing at the second request,
+// responding ranged requests with malformed partial content
+type MalformedRangeHandler struct {
+	Requests int32
+	Write    func(w http.ResponseWriter, content string, start int)
+}
+
+// RewrittenHandler serves a thread whose first line is rewritten at the
+// second request, keeping its length. Range is ignored if IgnoreRange is set.
+type RewrittenHandler struct {
+	Requests    int32
+	IgnoreRange bool
+	Contents    []string
+}
+
+func (h *RewrittenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requests := atomic.AddInt32(&h.Requests, 1)
+
+	content := h.Contents[len(h.Contents)-1]
+	if requests == 1 {
+		content = h.Contents[0]
+	}
+
+	if h.IgnoreRange {
+		r.Header.Del("Range")
+	}
+
+	w.Header().Add("Content-Type", "text/plain")
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+}
+
+func (h *MalformedRangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const (
+		ContentAtFirst = "OK<>1<>dat\n"
+		ContentDelta   = "delta<>2\n"
+	)
+
+	requests := atomic.AddInt32(&h.Requests, 1)
+
+	w.Header().Add("Content-Type", "text/plain")
+
+	if r.Header.Get("Range") != "" {
+		h.Write(w, ContentAtFirst+ContentDelta, requestedRangeStart(r))
+	} else if requests == 1 {
+		w.Write([]byte(ContentAtFirst))
+	} else {
+		w.Write([]byte(ContentAtFirst + ContentDelta))
+	}
+}
+
+// ArchivedHandler serves a thread which falls into dat落ち after the first
+// request
+type ArchivedHandler struct {
+	Requests int32
+}
+
+func (h *ArchivedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.Requests, 1)
+
+	w.Header().Add("Content-Type", "text/plain")
+
+	if r.Header.Get("Range") == "" {
+		w.Write([]byte("OK<>1<>dat\n"))
+	} else {
+		w.WriteHeader(203)
+		w.Write([]byte("archived"))
+	}
+}
+
+// GzipHandler serves gzip-encoded content if accepted, and applies ranges
+// only to identity-encoded content
+type GzipHandler struct {
+	mu                   sync.Mutex
+	RangeAcceptEncodings []string
+}
+
+func (h *GzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const Content = "OK<>1<>dat\ndelta<>2\n"
+
+	w.Header().Add("Content-Type", "text/plain")
+
+	if r.Header.Get("Range") != "" {
+		h.mu.Lock()
+		h.RangeAcceptEncodings = append(h.RangeAcceptEncodings, r.Header.Get("Accept-Encoding"))
+		h.mu.Unlock()
+	}
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(Content))
+		gw.Close()
+	} else {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(Content))
+	}
+}
+
+// BrokenHandler drops the connection without response after Release is
+// closed
+type BrokenHandler struct {
+	Release chan struct{}
+}
+
+func (h *BrokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	<-h.Release
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+// SlowHandler serves large content in chunks after Release is closed
+type SlowHandler struct {
+	Release chan struct{}
+}
+
+func (h *SlowHandler) Content() string {
+	var buf bytes.Buffer
+	for i := 1; i <= 5000; i++ {
+		fmt.Fprintf(&buf, "Name<>sage<>2013/01/01<>Post %d<>\n", i)
+	}
+	return buf.String()
+}
+
+func (h *SlowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	<-h.Release
+
+	content := h.Content()
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+
+	for len(content) > 0 {
+		n := 8192
+		if n > len(content) {
+			n = len(content)
+		}
+		w.Write([]byte(content[:n]))
+		w.(http.Flusher).Flush()
+		content = content[n:]
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// StaleHandler serves content only at first; ranged requests fail with
+// StatusCode, or hang until Release is closed
+type StaleHandler struct {
+	StatusCode int
+	Release    chan struct{}
+}
+
+func (h *StaleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK<>1<>dat\n"))
+		return
+	}
+
+	if h.Release != nil {
+		<-h.Release
+	}
+	http.Error(w, "unavailable", h.StatusCode)
+}
+
+// GrowingHandler appends a post for every request
+type GrowingHandler struct {
+	posts int32
+}
+
+func (h *GrowingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	posts := atomic.AddInt32(&h.posts, 1)
+
+	var buf bytes.Buffer
+	for i := 1; i <= int(posts); i++ {
+		fmt.Fprintf(&buf, "Name<>sage<>2013/01/01<>Post %d<>\n", i)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// SubjectHandler serves subject.txt in CP932, in which a thread is created
+// and another one grows after the first request
+type SubjectHandler struct {
+	requests int32
+}
+
+func (h *SubjectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subject, etag := "1363665368.dat<>スレッド (10)\n1363600000.dat<>古いスレ (5)\n", `"subject-1"`
+	if atomic.AddInt32(&h.requests, 1) > 1 {
+		subject, etag = "1363700000.dat<>新スレ (1)\n1363665368.dat<>スレッド (12)\n1363600000.dat<>古いスレ (5)\n", `"subject-2"`
+	}
+
+	content, err := japanese.ShiftJIS.NewEncoder().String(subject)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+}
+
 func Test200(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "etch_test")
 	if err != nil {
@@ -86,7 +311,7 @@ func Test200(t *testing.T) {
 	})
 }
 
-func TestControl(t *testing.T) {
+func TestCompressedCache(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "etch_test")
 	if err != nil {
 		t.Fatal(err)
@@ -95,19 +320,1124 @@ func TestControl(t *testing.T) {
 	t.Logf("Cache root: %s", tmpDir)
 
 	proxy := NewProxyServer(tmpDir)
-	control := NewControlServer(proxy)
+	proxy.Cache.Compression = EncodingGzip
 
-	etchHttpServer := httptest.NewServer(control)
+	testServer := httptest.NewServer(nil)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
 	defer etchHttpServer.Close()
 
-	client := &http.Client{}
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
 
-	Convey("On non-proxied request", t, func() {
-		Convey("GET /", func () {
-			resp, err := client.Get(etchHttpServer.URL)
+	get := func() string {
+		resp, err := client.Get(testServer.URL + "/200.dat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	Convey("An EtchProxy with compressed cache", t, func() {
+		So(get(), ShouldEqual, "OK<>1<>dat\n")
+		So(get(), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+
+		u, _ := url.Parse(testServer.URL + "/200.dat")
+		meta, err := proxy.Cache.GetEntry(u).GetMeta()
+		So(err, ShouldBeNil)
+		So(meta.StatusCode, ShouldEqual, 200)
+		So(meta.Encoding, ShouldEqual, EncodingGzip)
+		So(meta.Size, ShouldEqual, len("OK<>1<>dat\ndelta<>2\n"))
+	})
+}
+
+func TestGzip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	events := make(chan Event, 100)
+	ch := proxy.Listeners.Create()
+	defer proxy.Listeners.Remove(ch)
+	go func() {
+		for e := range ch {
+			events <- e
+		}
+	}()
+
+	gzipHandler := &GzipHandler{}
+
+	mux := http.NewServeMux()
+	mux.Handle("/gzip.dat", gzipHandler)
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}
+	client := &http.Client{Transport: tr}
+
+	get := func(acceptEncoding string) (string, http.Header) {
+		req, _ := http.NewRequest("GET", testServer.URL+"/gzip.dat", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			body, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content), resp.Header
+	}
+
+	Convey("An EtchProxy with gzip-capable upstream", t, func() {
+		content, header := get("gzip")
+		So(content, ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+		So(header.Get("Content-Encoding"), ShouldEqual, "gzip")
+		So(header.Get("Vary"), ShouldEqual, "Accept-Encoding")
+
+		u, _ := url.Parse(testServer.URL + "/gzip.dat")
+		cached, _, err := proxy.Cache.GetEntry(u).GetContent()
+		So(err, ShouldBeNil)
+		So(string(cached), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+
+		select {
+		case e := <-events:
+			So(e, ShouldHaveSameTypeAs, CacheUpdateEvent{})
+			So(e.(CacheUpdateEvent).URL.String(), ShouldEqual, u.String())
+			So(e.(CacheUpdateEvent).Since, ShouldEqual, 1)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for update")
+		}
+
+		content, header = get("")
+		So(content, ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+		So(header.Get("Content-Encoding"), ShouldEqual, "")
+		So(header.Get("Vary"), ShouldEqual, "Accept-Encoding")
+		So(gzipHandler.RangeAcceptEncodings, ShouldResemble, []string{"identity"})
+
+		// Nothing was appended
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected event: %#v", e)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestMalformedContentRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	events := make(chan Event, 100)
+	ch := proxy.Listeners.Create()
+	defer proxy.Listeners.Remove(ch)
+	go func() {
+		for e := range ch {
+			events <- e
+		}
+	}()
+
+	handlers := map[string]*MalformedRangeHandler{
+		"missing": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.WriteHeader(206)
+			w.Write([]byte(content[start:]))
+		}},
+		"invalid": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.Header().Set("Content-Range", "bytes abc")
+			w.WriteHeader(206)
+			w.Write([]byte(content[start:]))
+		}},
+		"start": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start+1, len(content)-1, len(content)))
+			w.WriteHeader(206)
+			w.Write([]byte(content[start:]))
+		}},
+		"short": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+3, len(content)))
+			w.WriteHeader(206)
+			w.Write([]byte(content[start : start+4]))
+		}},
+		"length": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.WriteHeader(206)
+			w.Write([]byte(content[start:] + "garbage\n"))
+		}},
+		"multipart": {Write: func(w http.ResponseWriter, content string, start int) {
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary=BOUNDARY")
+			w.WriteHeader(206)
+			fmt.Fprintf(w, "--BOUNDARY\r\nContent-Type: text/plain\r\nContent-Range: bytes %d-%d/%d\r\n\r\n%s\r\n--BOUNDARY--\r\n",
+				start, len(content)-1, len(content), content[start:])
+		}},
+	}
+
+	mux := http.NewServeMux()
+	for name, handler := range handlers {
+		mux.Handle("/range/"+name+".dat", handler)
+	}
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	get := func(u string) string {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	Convey("On malformed partial content", t, func() {
+		for _, name := range []string{"missing", "invalid", "start", "short", "length", "multipart"} {
+			u, _ := url.Parse(testServer.URL + "/range/" + name + ".dat")
+
+			Convey("Deletes cache and re-fetches: "+name, func() {
+				So(get(u.String()), ShouldEqual, "OK<>1<>dat\n")
+				So(get(u.String()), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+				So(atomic.LoadInt32(&handlers[name].Requests), ShouldEqual, 3)
+
+				cached, _, err := proxy.Cache.GetEntry(u).GetContent()
+				So(err, ShouldBeNil)
+				So(string(cached), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+
+				var invalidatedEvent CacheInvalidatedEvent
+				for invalidatedEvent.URL == nil {
+					if e, ok := (<-events).(CacheInvalidatedEvent); ok {
+						invalidatedEvent = e
+					}
+				}
+				So(invalidatedEvent.URL.String(), ShouldEqual, u.String())
+				So(invalidatedEvent.Reason, ShouldEqual, InvalidationReasonContentRange)
+			})
+		}
+	})
+}
+
+func TestRewritten(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	events := make(chan Event, 100)
+	ch := proxy.Listeners.Create()
+	defer proxy.Listeners.Remove(ch)
+	go func() {
+		for e := range ch {
+			events <- e
+		}
+	}()
+
+	// Returns the CacheInvalidatedEvent and PostsRewrittenEvent broadcast
+	drainEvents := func() (*CacheInvalidatedEvent, *PostsRewrittenEvent) {
+		var (
+			invalidated *CacheInvalidatedEvent
+			rewritten   *PostsRewrittenEvent
+		)
+		for {
+			select {
+			case e := <-events:
+				switch e := e.(type) {
+				case CacheInvalidatedEvent:
+					invalidated = &e
+				case PostsRewrittenEvent:
+					rewritten = &e
+				}
+			case <-time.After(100 * time.Millisecond):
+				return invalidated, rewritten
+			}
+		}
+	}
+
+	handlers := map[string]*RewrittenHandler{
+		"rewritten":      {Contents: []string{"OK<>1<>dat\n", "NG<>1<>dat\ndelta<>2\n"}},
+		"full-rewritten": {IgnoreRange: true, Contents: []string{"OK<>1<>dat\n", "NG<>1<>dat\ndelta<>2\n"}},
+		"full-appended":  {IgnoreRange: true, Contents: []string{"OK<>1<>dat\n", "OK<>1<>dat\ndelta<>2\n"}},
+	}
+
+	mux := http.NewServeMux()
+	for name, handler := range handlers {
+		mux.Handle("/"+name+".dat", handler)
+	}
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	get := func(u string) string {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	Convey("A thread rewritten keeping its trailing newline", t, func() {
+		u, _ := url.Parse(testServer.URL + "/rewritten.dat")
+
+		So(get(u.String()), ShouldEqual, "OK<>1<>dat\n")
+		So(get(u.String()), ShouldEqual, "NG<>1<>dat\ndelta<>2\n")
+		So(atomic.LoadInt32(&handlers["rewritten"].Requests), ShouldEqual, 3)
+
+		e, rewritten := drainEvents()
+		So(e, ShouldNotBeNil)
+		So(e.Reason, ShouldEqual, InvalidationReasonOverlap)
+		So(rewritten, ShouldNotBeNil)
+		So(rewritten.Changed, ShouldResemble, []int{1})
+		So(rewritten.Removed, ShouldBeEmpty)
+
+		cached, _, err := proxy.Cache.GetEntry(u).GetContent()
+		So(err, ShouldBeNil)
+		So(string(cached), ShouldEqual, "NG<>1<>dat\ndelta<>2\n")
 
+		Convey("Its previous version is available from the control server", func() {
+			controlServer := httptest.NewServer(NewControlServer(proxy))
+			defer controlServer.Close()
+
+			resp, err := http.Get(controlServer.URL + "/cache/versions?url=" + url.QueryEscape(u.String()))
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			var versions []CacheVersion
+			So(json.NewDecoder(resp.Body).Decode(&versions), ShouldBeNil)
+			So(versions, ShouldHaveLength, 1)
+
+			resp, err = http.Get(controlServer.URL + "/cache?url=" + url.QueryEscape(u.String()) + "&version=" + versions[0].ID)
 			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			content, _ := ioutil.ReadAll(resp.Body)
 			So(resp.StatusCode, ShouldEqual, 200)
+			So(string(content), ShouldEqual, "OK<>1<>dat\n")
+		})
+	})
+
+	Convey("A thread rewritten, served without respecting Range", t, func() {
+		u, _ := url.Parse(testServer.URL + "/full-rewritten.dat")
+
+		So(get(u.String()), ShouldEqual, "OK<>1<>dat\n")
+		So(get(u.String()), ShouldEqual, "NG<>1<>dat\ndelta<>2\n")
+
+		e, rewritten := drainEvents()
+		So(e, ShouldNotBeNil)
+		So(e.Reason, ShouldEqual, InvalidationReasonHash)
+		So(rewritten, ShouldNotBeNil)
+		So(rewritten.Changed, ShouldResemble, []int{1})
+
+		cached, _, err := proxy.Cache.GetEntry(u).GetContent()
+		So(err, ShouldBeNil)
+		So(string(cached), ShouldEqual, "NG<>1<>dat\ndelta<>2\n")
+	})
+
+	Convey("A thread appended, served without respecting Range", t, func() {
+		u, _ := url.Parse(testServer.URL + "/full-appended.dat")
+
+		So(get(u.String()), ShouldEqual, "OK<>1<>dat\n")
+		So(get(u.String()), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+		e, rewritten := drainEvents()
+		So(e, ShouldBeNil)
+		So(rewritten, ShouldBeNil)
+
+		cached, _, err := proxy.Cache.GetEntry(u).GetContent()
+		So(err, ShouldBeNil)
+		So(string(cached), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+
+		meta, err := proxy.Cache.GetEntry(u).GetMeta()
+		So(err, ShouldBeNil)
+		So(meta.LineCount, ShouldEqual, 2)
+	})
+}
+
+func TestCoalescedUpstreamError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	brokenHandler := &BrokenHandler{Release: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.Handle("/broken.dat", brokenHandler)
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	Convey("When upstream fails while requests are coalesced", t, func() {
+		statusCodes := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				resp, err := client.Get(testServer.URL + "/broken.dat")
+				if err != nil {
+					statusCodes <- 0
+					return
+				}
+				resp.Body.Close()
+				statusCodes <- resp.StatusCode
+			}()
+		}
+
+		for proxy.Coalescer.Stats().Waiting == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(brokenHandler.Release)
+
+		Convey("Waiters are released with an error", func() {
+			codes := []int{<-statusCodes, <-statusCodes}
+			So(codes, ShouldContain, http.StatusBadGateway)
+			So(proxy.Coalescer.Stats().Failed, ShouldEqual, 1)
+			So(proxy.Coalescer.Stats().Waiting, ShouldEqual, 0)
+
+			u, _ := url.Parse(testServer.URL + "/broken.dat")
+			_, leader := proxy.Coalescer.Join(proxy.Cache.UrlToKey(u))
+			So(leader, ShouldBeTrue)
+		})
+	})
+}
+
+func TestCoalescedConcurrentRequests(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	slowHandler := &SlowHandler{Release: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.Handle("/slow.dat", slowHandler)
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	Convey("When many requests for a dat are coalesced", t, func() {
+		const n = 20
+
+		contents := make(chan string, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				resp, err := client.Get(testServer.URL + "/slow.dat")
+				if err != nil {
+					contents <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+
+				content, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					contents <- err.Error()
+					return
+				}
+				contents <- string(content)
+			}()
+		}
+
+		for proxy.Coalescer.Stats().Waiting < n-1 {
+			time.Sleep(time.Millisecond)
+		}
+		close(slowHandler.Release)
+
+		Convey("Every request receives the whole content", func() {
+			expected := slowHandler.Content()
+			for i := 0; i < n; i++ {
+				So(<-contents, ShouldEqual, expected)
+			}
+
+			So(proxy.Coalescer.Stats().Leaders, ShouldEqual, 1)
+			So(proxy.Coalescer.Stats().Coalesced, ShouldEqual, n-1)
+
+			resp, err := client.Get(testServer.URL + "/slow.dat")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			content, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, expected)
+		})
+	})
+}
+
+func TestCoalescedLeaderGone(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	content := (&SlowHandler{}).Content()
+	release := make(chan struct{})
+	resume := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gone.dat", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+
+		w.Write([]byte(content[:len(content)/2]))
+		w.(http.Flusher).Flush()
+
+		<-resume
+		for rest := content[len(content)/2:]; len(rest) > 0; {
+			n := 8192
+			if n > len(rest) {
+				n = len(rest)
+			}
+			w.Write([]byte(rest[:n]))
+			w.(http.Flusher).Flush()
+			rest = rest[n:]
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+	}
+
+	Convey("When the client of the leader goes away", t, func() {
+		leaderResps := make(chan *http.Response, 1)
+		go func() {
+			resp, err := newClient().Get(testServer.URL + "/gone.dat")
+			if err != nil {
+				t.Error(err)
+			}
+			leaderResps <- resp
+		}()
+
+		for proxy.Coalescer.Stats().Leaders < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		contents := make(chan string, 1)
+		go func() {
+			resp, err := newClient().Get(testServer.URL + "/gone.dat")
+			if err != nil {
+				contents <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+
+			content, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				contents <- err.Error()
+				return
+			}
+			contents <- string(content)
+		}()
+
+		for proxy.Coalescer.Stats().Waiting < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+
+		leaderResp := <-leaderResps
+		So(leaderResp, ShouldNotBeNil)
+
+		leaderHead := make([]byte, 1000)
+		_, err := io.ReadFull(leaderResp.Body, leaderHead)
+		So(err, ShouldBeNil)
+		leaderResp.Body.Close()
+
+		time.Sleep(100 * time.Millisecond)
+		close(resume)
+
+		Convey("Waiters receive the whole content", func() {
+			So(<-contents, ShouldEqual, content)
+
+			resp, err := newClient().Get(testServer.URL + "/gone.dat")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			cached, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(cached), ShouldEqual, content)
+		})
+	})
+}
+
+func TestStale(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+	proxy.ServeStale = true
+	proxy.UpstreamTimeout = 100 * time.Millisecond
+
+	staleHandlers := map[string]*StaleHandler{
+		"fail": {StatusCode: http.StatusServiceUnavailable},
+		"hang": {Release: make(chan struct{})},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/200.dat", &OKHandler{})
+	for name, handler := range staleHandlers {
+		mux.Handle("/stale/"+name+".dat", handler)
+	}
+
+	// Re-fetching after 416 hangs
+	var refetchRequests int32
+	mux.HandleFunc("/stale/refetch.dat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if atomic.AddInt32(&refetchRequests, 1) > 1 {
+			<-staleHandlers["hang"].Release
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK<>1<>dat\n"))
+	})
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	downServer := httptest.NewServer(nil)
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	defer close(staleHandlers["hang"].Release)
+
+	get := func(url string) (*http.Response, string) {
+		resp, err := client.Get(url)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+
+		content, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		return resp, string(content)
+	}
+
+	Convey("When upstream fails revalidating cache", t, func() {
+		for _, u := range []string{testServer.URL + "/stale/fail.dat", testServer.URL + "/stale/hang.dat", testServer.URL + "/stale/refetch.dat", downServer.URL + "/200.dat"} {
+			resp, _ := get(u)
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("X-Etch-Stale"), ShouldEqual, "")
+		}
+		downServer.Close()
+
+		Convey("Cache is served as stale", func() {
+			for _, u := range []string{testServer.URL + "/stale/fail.dat", testServer.URL + "/stale/hang.dat", testServer.URL + "/stale/refetch.dat", downServer.URL + "/200.dat"} {
+				resp, content := get(u)
+				So(resp.StatusCode, ShouldEqual, 200)
+				So(resp.Header.Get("X-Etch-Stale"), ShouldEqual, StaleReasonError)
+				So(resp.Header.Get("Warning"), ShouldStartWith, "111 ")
+				So(content, ShouldEqual, "OK<>1<>dat\n")
+			}
+		})
+	})
+
+	Convey("When upstream times out and stale cache is not served", t, func() {
+		proxy.ServeStale = false
+		defer func() { proxy.ServeStale = true }()
+
+		Convey("Gateway timeout is responded", func() {
+			resp, _ := get(testServer.URL + "/stale/hang.dat")
+			So(resp.StatusCode, ShouldEqual, http.StatusGatewayTimeout)
+
+			resp, _ = get(testServer.URL + "/stale/refetch.dat")
+			So(resp.StatusCode, ShouldEqual, http.StatusGatewayTimeout)
+		})
+	})
+
+	Convey("When offline", t, func() {
+		proxy.Offline = true
+		defer func() { proxy.Offline = false }()
+
+		Convey("Cache is served without contacting upstream", func() {
+			resp, content := get(testServer.URL + "/stale/fail.dat")
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("X-Etch-Stale"), ShouldEqual, StaleReasonOffline)
+			So(resp.Header.Get("Warning"), ShouldStartWith, "112 ")
+			So(content, ShouldEqual, "OK<>1<>dat\n")
+		})
+
+		Convey("Requests not cached fail", func() {
+			resp, _ := get(testServer.URL + "/200.dat")
+			So(resp.StatusCode, ShouldEqual, http.StatusGatewayTimeout)
+		})
+	})
+}
+
+func TestFreshness(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+	proxy.FreshFor = time.Minute
+
+	var upstreamRequests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamRequests, 1)
+		http.DefaultServeMux.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	Convey("When a thread was checked just now", t, func() {
+		resp, err := client.Get(testServer.URL + "/200.dat")
+		So(err, ShouldBeNil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		So(atomic.LoadInt32(&upstreamRequests), ShouldEqual, 1)
+
+		Convey("Cache is served without contacting upstream", func() {
+			resp, err := client.Get(testServer.URL + "/200.dat")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			content, _ := ioutil.ReadAll(resp.Body)
+			So(string(content), ShouldEqual, "OK<>1<>dat\n")
+			So(resp.Header.Get("Age"), ShouldEqual, "0")
+			So(resp.Header.Get("X-Etch-Checked-At"), ShouldNotEqual, "")
+			So(atomic.LoadInt32(&upstreamRequests), ShouldEqual, 1)
+
+			Convey("Unless the window is disabled for the host", func() {
+				// The most specific one applies
+				proxy.HostFreshFor = map[string]time.Duration{"0.0.1": time.Hour, "127.0.0.1": 0, "0.1": time.Hour}
+				defer func() { proxy.HostFreshFor = nil }()
+
+				resp, err := client.Get(testServer.URL + "/200.dat")
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+
+				content, _ := ioutil.ReadAll(resp.Body)
+				So(string(content), ShouldEqual, "OK<>1<>dat\ndelta<>2\n")
+				So(resp.Header.Get("Age"), ShouldEqual, "")
+				So(atomic.LoadInt32(&upstreamRequests), ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestWatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+	proxy.Watcher.MinInterval = 20 * time.Millisecond
+	proxy.Watcher.MaxInterval = time.Second
+
+	events := make(chan Event, 100)
+	ch := proxy.Listeners.Create()
+	defer proxy.Listeners.Remove(ch)
+	go func() {
+		for e := range ch {
+			events <- e
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/growing.dat", &GrowingHandler{})
+	mux.Handle("/gzip.dat", &GzipHandler{})
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	controlServer := httptest.NewServer(NewControlServer(proxy))
+	defer controlServer.Close()
+
+	stop := proxy.Watcher.Start()
+	defer stop()
+
+	watch := func(method, u string) int {
+		req, _ := http.NewRequest(method, controlServer.URL+"/watch?url="+url.QueryEscape(u), nil)
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	Convey("When threads are watched", t, func() {
+		growingURL := testServer.URL + "/growing.dat"
+		stillURL := testServer.URL + "/gzip.dat"
+
+		So(watch("POST", growingURL), ShouldEqual, http.StatusCreated)
+		So(watch("POST", growingURL), ShouldEqual, http.StatusNoContent)
+		So(watch("POST", stillURL), ShouldEqual, http.StatusCreated)
+
+		Convey("Updates are fetched in background", func() {
+			updates := 0
+			timeout := time.After(5 * time.Second)
+			for updates < 3 {
+				select {
+				case e := <-events:
+					if e, ok := e.(CacheUpdateEvent); ok && e.URL.String() == growingURL {
+						updates++
+					}
+				case <-timeout:
+					t.Fatal("timed out waiting for updates")
+				}
+			}
+
+			Convey("Threads not growing are checked less often", func() {
+				var intervals map[string]float64
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					resp, err := http.Get(controlServer.URL + "/watch")
+					So(err, ShouldBeNil)
+
+					var threads []map[string]interface{}
+					err = json.NewDecoder(resp.Body).Decode(&threads)
+					resp.Body.Close()
+					So(err, ShouldBeNil)
+					So(len(threads), ShouldEqual, 2)
+
+					intervals = make(map[string]float64)
+					for _, thread := range threads {
+						intervals[thread["url"].(string)] = thread["interval"].(float64)
+					}
+					if intervals[stillURL] > 0.04 {
+						break
+					}
+				}
+
+				So(intervals[stillURL], ShouldBeGreaterThan, 0.04)
+				So(intervals[growingURL], ShouldBeLessThan, intervals[stillURL])
+
+				So(watch("DELETE", stillURL), ShouldEqual, http.StatusNoContent)
+				So(watch("DELETE", stillURL), ShouldEqual, http.StatusNotFound)
+				So(len(proxy.Watcher.Threads()), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestBoards(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	events := make(chan Event, 100)
+	ch := proxy.Listeners.Create()
+	defer proxy.Listeners.Remove(ch)
+	go func() {
+		for e := range ch {
+			events <- e
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/book/subject.txt", &SubjectHandler{})
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	controlServer := httptest.NewServer(NewControlServer(proxy))
+	defer controlServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	getJson := func(u string, v interface{}) {
+		resp, err := http.Get(u)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+
+		So(resp.StatusCode, ShouldEqual, 200)
+		So(json.NewDecoder(resp.Body).Decode(v), ShouldBeNil)
+	}
+
+	Convey("When subject.txt is fetched again", t, func() {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Get(testServer.URL + "/book/subject.txt")
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		Convey("Changes of threads are broadcast", func() {
+			var (
+				created *ThreadCreatedEvent
+				changed *ResCountChangedEvent
+			)
+			timeout := time.After(5 * time.Second)
+			for created == nil || changed == nil {
+				select {
+				case e := <-events:
+					switch e := e.(type) {
+					case ThreadCreatedEvent:
+						created = &e
+					case ResCountChangedEvent:
+						changed = &e
+					}
+				case <-timeout:
+					t.Fatal("timed out waiting for events")
+				}
+			}
+
+			So(created.URL.String(), ShouldEqual, testServer.URL+"/book/dat/1363700000.dat")
+			So(created.Title, ShouldEqual, "新スレ")
+			So(created.ResCount, ShouldEqual, 1)
+
+			So(changed.URL.String(), ShouldEqual, testServer.URL+"/book/dat/1363665368.dat")
+			So(changed.ResCount, ShouldEqual, 12)
+			So(changed.Previous, ShouldEqual, 10)
+		})
+
+		Convey("Boards and threads are listed", func() {
+			var boards []*Board
+			getJson(controlServer.URL+"/boards", &boards)
+			So(len(boards), ShouldEqual, 1)
+			So(boards[0].Name, ShouldEqual, "book")
+			So(boards[0].Threads, ShouldEqual, 3)
+
+			var threads []*ThreadSubject
+			getJson(controlServer.URL+"/boards/"+boards[0].Host+"/book/threads", &threads)
+			So(len(threads), ShouldEqual, 3)
+			So(threads[1].Key, ShouldEqual, "1363665368")
+			So(threads[1].Title, ShouldEqual, "スレッド")
+			So(threads[1].ResCount, ShouldEqual, 12)
+
+			resp, err := http.Get(controlServer.URL + "/boards/" + boards[0].Host + "/news/threads")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Cached subject.txt is transcoded to UTF-8 on request", func() {
+			cacheUrl := controlServer.URL + "/cache?url=" + url.QueryEscape(testServer.URL+"/book/subject.txt")
+
+			get := func(u string, acceptCharset string) (*http.Response, string) {
+				req, _ := http.NewRequest("GET", u, nil)
+				if acceptCharset != "" {
+					req.Header.Set("Accept-Charset", acceptCharset)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+
+				body, err := ioutil.ReadAll(resp.Body)
+				So(err, ShouldBeNil)
+				return resp, string(body)
+			}
+
+			resp, body := get(cacheUrl+"&encoding=utf-8", "")
+			So(resp.StatusCode, ShouldEqual, 200)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/plain; charset=utf-8")
+			So(resp.Header.Get("ETag"), ShouldEqual, `"subject-2-utf8"`)
+			So(body, ShouldStartWith, "1363700000.dat<>新スレ (1)\n")
+
+			resp, body = get(cacheUrl, "utf-8, shift_jis;q=0.5")
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/plain; charset=utf-8")
+			So(resp.Header.Get("Vary"), ShouldEqual, "Accept-Charset")
+			So(body, ShouldStartWith, "1363700000.dat<>新スレ (1)\n")
+
+			Convey("but not by default, as the stored bytes are", func() {
+				resp, body := get(cacheUrl, "")
+				So(resp.Header.Get("Content-Type"), ShouldEqual, "text/plain")
+				So(resp.Header.Get("ETag"), ShouldEqual, `"subject-2"`)
+				So(body, ShouldNotContainSubstring, "新スレ")
+
+				resp, body = get(cacheUrl, "shift_jis, utf-8;q=0.5")
+				So(body, ShouldNotContainSubstring, "新スレ")
+
+				resp, _ = get(cacheUrl+"&encoding=euc-jp", "")
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+	})
+}
+
+func TestControl(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+	control := NewControlServer(proxy)
+
+	etchHttpServer := httptest.NewServer(control)
+	defer etchHttpServer.Close()
+
+	client := &http.Client{}
+
+	Convey("On non-proxied request", t, func() {
+		Convey("GET /", func () {
+			resp, err := client.Get(etchHttpServer.URL)
+
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, 200)
+		})
+	})
+}
+
+func Test203(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Cache root: %s", tmpDir)
+
+	proxy := NewProxyServer(tmpDir)
+
+	archivedHandler := &ArchivedHandler{}
+
+	mux := http.NewServeMux()
+	mux.Handle("/203.dat", archivedHandler)
+
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	etchHttpServer := httptest.NewServer(proxy)
+	defer etchHttpServer.Close()
+
+	proxyURL, _ := url.Parse(etchHttpServer.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	client := &http.Client{Transport: tr}
+
+	get := func() string {
+		resp, err := client.Get(testServer.URL + "/203.dat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	Convey("A dat落ち thread", t, func() {
+		So(get(), ShouldEqual, "OK<>1<>dat\n")
+		So(get(), ShouldEqual, "OK<>1<>dat\n")
+		So(atomic.LoadInt32(&archivedHandler.Requests), ShouldEqual, 2)
+
+		u, _ := url.Parse(testServer.URL + "/203.dat")
+		meta, err := proxy.Cache.GetEntry(u).GetMeta()
+		So(err, ShouldBeNil)
+		So(meta.Archived, ShouldBeTrue)
+		So(meta.StatusCode, ShouldEqual, 203)
+
+		Convey("Is served from cache without upstream requests", func() {
+			So(get(), ShouldEqual, "OK<>1<>dat\n")
+			So(atomic.LoadInt32(&archivedHandler.Requests), ShouldEqual, 2)
 		})
 	})
 }
@@ -32,3 +32,79 @@ func (e CacheDeleteEvent) Json() ([]byte, error) {
 		"url":   e.URL.String(),
 	})
 }
+
+// Reasons of CacheInvalidatedEvent
+const (
+	InvalidationReasonContentRange        = "contentRangeMismatch"
+	InvalidationReasonOverlap             = "overlapMismatch"
+	InvalidationReasonHash                = "contentHashMismatch"
+	InvalidationReasonRangeNotSatisfiable = "rangeNotSatisfiable"
+)
+
+// CacheInvalidatedEvent is broadcast when the cached content turned out not
+// to be a prefix of the upstream content, and is to be fetched again.
+type CacheInvalidatedEvent struct {
+	URL    *url.URL
+	Reason string
+	Detail string
+}
+
+func (e CacheInvalidatedEvent) Json() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":  "cacheInvalidated",
+		"url":    e.URL.String(),
+		"reason": e.Reason,
+		"detail": e.Detail,
+	})
+}
+
+// PostsRewrittenEvent is broadcast when the content replacing invalidated
+// cache is stored, listing posts which were rewritten or removed (あぼーん)
+// compared to the previous version.
+type PostsRewrittenEvent struct {
+	URL     *url.URL
+	Changed []int
+	Removed []int
+}
+
+func (e PostsRewrittenEvent) Json() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":   "postsRewritten",
+		"url":     e.URL.String(),
+		"changed": e.Changed,
+		"removed": e.Removed,
+	})
+}
+
+// ThreadCreatedEvent is broadcast when a thread appears in subject.txt.
+type ThreadCreatedEvent struct {
+	URL      *url.URL
+	Title    string
+	ResCount int
+}
+
+func (e ThreadCreatedEvent) Json() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":    "threadCreated",
+		"url":      e.URL.String(),
+		"title":    e.Title,
+		"resCount": e.ResCount,
+	})
+}
+
+// ResCountChangedEvent is broadcast when the response count of a thread in
+// subject.txt changes.
+type ResCountChangedEvent struct {
+	URL      *url.URL
+	ResCount int
+	Previous int
+}
+
+func (e ResCountChangedEvent) Json() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":    "resCountChanged",
+		"url":      e.URL.String(),
+		"resCount": e.ResCount,
+		"previous": e.Previous,
+	})
+}
@@ -0,0 +1,398 @@
+package etch
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EvictionPolicy int
+
+const (
+	// EvictLRU evicts least recently accessed entries first
+	EvictLRU EvictionPolicy = iota
+	// EvictOldest evicts entries with the oldest mtime first
+	EvictOldest
+)
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru":
+		return EvictLRU, nil
+	case "oldest":
+		return EvictOldest, nil
+	default:
+		return 0, fmt.Errorf("unknown eviction policy: %q", s)
+	}
+}
+
+type RetentionPolicy int
+
+const (
+	// RetainAsLive lets archived entries follow the eviction policy as
+	// live ones
+	RetainAsLive RetentionPolicy = iota
+	// RetainForever never evicts archived entries; they do not count
+	// toward the limits either
+	RetainForever
+)
+
+// accessTable remembers when each key was accessed last. Keys not
+// accessed since startup fall back to their mtime.
+type accessTable struct {
+	sync.Mutex
+	times map[string]time.Time
+}
+
+func (table *accessTable) touch(key string) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.times == nil {
+		table.times = make(map[string]time.Time)
+	}
+	table.times[key] = time.Now()
+}
+
+func (table *accessTable) forget(key string) {
+	table.Lock()
+	defer table.Unlock()
+
+	delete(table.times, key)
+}
+
+func (table *accessTable) get(key string) (time.Time, bool) {
+	table.Lock()
+	defer table.Unlock()
+
+	t, ok := table.times[key]
+	return t, ok
+}
+
+// usageTable keeps the stored size of each entry, including its sidecars,
+// as of the last Evict and updated by writes since, so that writes can tell
+// whether to evict without walking the storage. Meta is not counted but
+// by Evict, which corrects the table as it walks the storage anyway.
+type usageTable struct {
+	sync.Mutex
+	entries map[string]*entryUsage
+	size    int64
+	count   int
+
+	// Entries not counting toward the limits
+	retained func(key string) bool
+}
+
+type entryUsage struct {
+	content    int64
+	sidecars   int64
+	hasContent bool
+}
+
+func (usage *entryUsage) size() int64 {
+	return usage.content + usage.sidecars
+}
+
+func (table *usageTable) reset(entries map[string]*entryUsage, retained func(key string) bool) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.entries = entries
+	table.retained = retained
+	table.size = 0
+	table.count = 0
+	for _, usage := range entries {
+		table.size += usage.size()
+		if usage.hasContent {
+			table.count++
+		}
+	}
+}
+
+// update applies f to the usage of key, unless the table is yet to be
+// filled by Evict or the entry is retained.
+func (table *usageTable) update(key string, f func(*entryUsage)) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.entries == nil {
+		return
+	}
+
+	if table.retained(key) {
+		table.remove(key)
+		return
+	}
+
+	usage, ok := table.entries[key]
+	if !ok {
+		usage = &entryUsage{}
+		table.entries[key] = usage
+	}
+
+	table.size -= usage.size()
+	if usage.hasContent {
+		table.count--
+	}
+
+	f(usage)
+
+	table.size += usage.size()
+	if usage.hasContent {
+		table.count++
+	}
+}
+
+func (table *usageTable) setContent(key string, size int64) {
+	table.update(key, func(usage *entryUsage) {
+		usage.content = size
+		usage.hasContent = true
+	})
+}
+
+func (table *usageTable) deleteContent(key string) {
+	table.update(key, func(usage *entryUsage) {
+		usage.content = 0
+		usage.hasContent = false
+	})
+}
+
+func (table *usageTable) addSidecar(key string, size int64) {
+	table.update(key, func(usage *entryUsage) {
+		usage.sidecars += size
+	})
+}
+
+func (table *usageTable) forget(key string) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.remove(key)
+}
+
+func (table *usageTable) remove(key string) {
+	usage, ok := table.entries[key]
+	if !ok {
+		return
+	}
+
+	table.size -= usage.size()
+	if usage.hasContent {
+		table.count--
+	}
+	delete(table.entries, key)
+}
+
+// exceeds reports whether the cache may be over the limits, which is the
+// case until Evict fills the table.
+func (table *usageTable) exceeds(maxSize int64, maxEntries int) bool {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.entries == nil {
+		return true
+	}
+
+	return maxSize > 0 && table.size > maxSize || maxEntries > 0 && table.count > maxEntries
+}
+
+func (cache *Cache) hasLimits() bool {
+	return cache.MaxSize > 0 || cache.MaxEntries > 0
+}
+
+// evictionCandidate is an entry with its sidecars. Entries whose content
+// was deleted may still have snapshots.
+type evictionCandidate struct {
+	entryUsage
+	key  string
+	time time.Time
+}
+
+// Evict deletes entries until the cache fits within MaxSize and
+// MaxEntries, in the order of EvictionPolicy. Sidecars, including
+// snapshots, count toward MaxSize and are deleted with the entry. OnEvict
+// is called for each evicted URL.
+func (cache *Cache) Evict() ([]*url.URL, error) {
+	evicted := make([]*url.URL, 0)
+
+	if !cache.hasLimits() {
+		return evicted, nil
+	}
+
+	keys, err := cache.Storage.List()
+	if err != nil {
+		return evicted, err
+	}
+
+	entries := make(map[string]*evictionCandidate)
+
+	for _, key := range keys {
+		fileInfo, err := cache.Storage.Stat(key)
+		if err != nil {
+			continue
+		}
+
+		entryKey := entryKeyOf(key)
+		candidate, ok := entries[entryKey]
+		if !ok {
+			candidate = &evictionCandidate{key: entryKey}
+			entries[entryKey] = candidate
+		}
+
+		if key == entryKey {
+			candidate.content = fileInfo.Size()
+			candidate.hasContent = true
+			candidate.time = fileInfo.ModTime()
+		} else {
+			candidate.sidecars += fileInfo.Size()
+			if !candidate.hasContent && fileInfo.ModTime().After(candidate.time) {
+				candidate.time = fileInfo.ModTime()
+			}
+		}
+	}
+
+	candidates := make([]evictionCandidate, 0, len(entries))
+	usages := make(map[string]*entryUsage, len(entries))
+	totalSize := int64(0)
+	count := 0
+
+	for key, candidate := range entries {
+		if candidate.hasContent && cache.isRetainedKey(key) {
+			continue
+		}
+
+		if cache.EvictionPolicy == EvictLRU {
+			if accessed, ok := cache.accessed.get(key); ok && accessed.After(candidate.time) {
+				candidate.time = accessed
+			}
+		}
+
+		candidates = append(candidates, *candidate)
+		usages[key] = &candidate.entryUsage
+		totalSize += candidate.size()
+		if candidate.hasContent {
+			count++
+		}
+	}
+
+	cache.usage.reset(usages, cache.isRetainedKey)
+
+	sort.Sort(byEvictionTime(candidates))
+
+	for _, candidate := range candidates {
+		overSize := cache.MaxSize > 0 && totalSize > cache.MaxSize
+		overEntries := cache.MaxEntries > 0 && count > cache.MaxEntries
+		if !overSize && !overEntries {
+			break
+		}
+
+		// Only snapshots left, which do not count as an entry
+		if !overSize && !candidate.hasContent {
+			continue
+		}
+
+		infof(cache, "Evicting %s", candidate.key)
+
+		// The key may not be of the URL normalized as of now
+		u, err := cache.KeyToUrl(candidate.key)
+		if err != nil {
+			warningf(cache, "Evicting %s: %s", candidate.key, err)
+		}
+
+		entry := cache.entryOfKey(candidate.key, u)
+		if err := entry.Delete(); err != nil && !os.IsNotExist(err) {
+			warningf(cache, "Evicting %s: %s", candidate.key, err)
+			continue
+		}
+		if err := entry.DeleteVersions(); err != nil {
+			warningf(cache, "Evicting versions of %s: %s", candidate.key, err)
+		}
+		cache.usage.forget(candidate.key)
+
+		totalSize -= candidate.size()
+		if !candidate.hasContent {
+			continue
+		}
+		count--
+
+		if u == nil {
+			continue
+		}
+		evicted = append(evicted, u)
+		if cache.OnEvict != nil {
+			cache.OnEvict(u)
+		}
+	}
+
+	return evicted, nil
+}
+
+func (cache *Cache) isArchivedKey(key string) bool {
+	meta, _ := readMeta(cache.Storage, key)
+	return meta != nil && meta.Archived
+}
+
+// isRetainedKey reports whether the entry of key is never evicted.
+func (cache *Cache) isRetainedKey(key string) bool {
+	return cache.ArchivedRetention == RetainForever && cache.isArchivedKey(key)
+}
+
+type byEvictionTime []evictionCandidate
+
+func (s byEvictionTime) Len() int           { return len(s) }
+func (s byEvictionTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEvictionTime) Less(i, j int) bool { return s[i].time.Before(s[j].time) }
+
+// evictIfExceeded runs Evict in background if the cache may be over the
+// limits.
+func (cache *Cache) evictIfExceeded() {
+	if !cache.hasLimits() || !cache.usage.exceeds(cache.MaxSize, cache.MaxEntries) {
+		return
+	}
+
+	cache.evictInBackground()
+}
+
+// evictInBackground runs Evict unless one is already running.
+func (cache *Cache) evictInBackground() {
+	if !cache.hasLimits() {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&cache.evicting, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&cache.evicting, 0)
+
+		if _, err := cache.Evict(); err != nil {
+			warningf(cache, "Eviction: %s", err)
+		}
+	}()
+}
+
+// StartSweeper runs eviction periodically. Call the returned function to
+// stop it.
+func (cache *Cache) StartSweeper(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				cache.evictInBackground()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
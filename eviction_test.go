@@ -0,0 +1,210 @@
+package etch_test
+
+import (
+	"fmt"
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type listCountingStorage struct {
+	Storage
+	lists int32
+}
+
+func (storage *listCountingStorage) List() ([]string, error) {
+	atomic.AddInt32(&storage.lists, 1)
+	return storage.Storage.List()
+}
+
+func TestEvict(t *testing.T) {
+	base := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+
+	setup := func(policy EvictionPolicy) (*Cache, []*url.URL) {
+		cache := NewMemoryCache()
+		cache.EvictionPolicy = policy
+
+		urls := make([]*url.URL, 3)
+		for i := range urls {
+			urls[i], _ = url.Parse(fmt.Sprintf("http://toro.2ch.net/book/dat/100000000%d.dat", i))
+			cache.GetEntry(urls[i]).FreshenContent([]byte("0123456789"), base.Add(time.Duration(i)*time.Hour))
+		}
+
+		return cache, urls
+	}
+
+	Convey("A cache without limits evicts nothing", t, func() {
+		cache, _ := setup(EvictOldest)
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(evicted, ShouldBeEmpty)
+		So(len(cache.Keys()), ShouldEqual, 3)
+	})
+
+	Convey("With EvictOldest and MaxEntries", t, func() {
+		cache, urls := setup(EvictOldest)
+		cache.MaxEntries = 2
+
+		deleted := make([]*url.URL, 0)
+		cache.OnEvict = func(u *url.URL) { deleted = append(deleted, u) }
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(len(evicted), ShouldEqual, 1)
+		So(evicted[0].String(), ShouldEqual, urls[0].String())
+		So(deleted, ShouldResemble, evicted)
+		So(len(cache.Keys()), ShouldEqual, 2)
+	})
+
+	Convey("With EvictLRU and MaxSize", t, func() {
+		cache, urls := setup(EvictLRU)
+		cache.MaxSize = 20
+
+		// urls[0] is the oldest, but recently accessed
+		cache.GetEntry(urls[0]).GetContent()
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(len(evicted), ShouldEqual, 1)
+		So(evicted[0].String(), ShouldEqual, urls[1].String())
+	})
+
+	Convey("With MaxSize, snapshots count toward the size", t, func() {
+		cache, urls := setup(EvictOldest)
+		cache.MaxVersions = 1
+		cache.MaxSize = 30
+
+		So(cache.GetEntry(urls[0]).SavePrevious(), ShouldBeNil)
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(len(evicted), ShouldEqual, 1)
+		So(evicted[0].String(), ShouldEqual, urls[0].String())
+
+		Convey("and are evicted after the entry is deleted", func() {
+			So(cache.GetEntry(urls[2]).SavePrevious(), ShouldBeNil)
+			So(cache.GetEntry(urls[2]).Delete(), ShouldBeNil)
+			cache.MaxSize = 10
+
+			versions, err := cache.GetEntry(urls[2]).Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldHaveLength, 1)
+
+			evicted, err := cache.Evict()
+			So(err, ShouldBeNil)
+			So(len(evicted), ShouldEqual, 1)
+			So(evicted[0].String(), ShouldEqual, urls[1].String())
+
+			versions, err = cache.GetEntry(urls[2]).Versions()
+			So(err, ShouldBeNil)
+			So(versions, ShouldBeEmpty)
+			So(len(cache.Keys()), ShouldEqual, 0)
+		})
+	})
+
+	Convey("With RetainForever, archived entries are never evicted", t, func() {
+		cache, urls := setup(EvictOldest)
+		cache.MaxEntries = 1
+		cache.ArchivedRetention = RetainForever
+
+		So(cache.GetEntry(urls[0]).MarkArchived(), ShouldBeNil)
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(len(evicted), ShouldEqual, 1)
+		So(evicted[0].String(), ShouldEqual, urls[1].String())
+
+		content, _, err := cache.GetEntry(urls[0]).GetContent()
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "0123456789")
+	})
+
+	Convey("Entries stored before the normalization changed are evicted", t, func() {
+		cache, urls := setup(EvictOldest)
+		cache.MaxEntries = 2
+
+		aliases, err := ParseHostAliases("toro.2ch.net=mirror.example.com")
+		So(err, ShouldBeNil)
+		cache.Normalizer = (&UrlNormalizer{HostAliases: aliases}).Normalize
+
+		evicted, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(len(evicted), ShouldEqual, 1)
+		So(evicted[0].String(), ShouldEqual, urls[0].String())
+
+		keys, err := cache.Storage.List()
+		So(err, ShouldBeNil)
+		So(keys, ShouldNotContain, "http/toro.2ch.net/book/dat/1000000000.dat")
+		So(keys, ShouldContain, "http/toro.2ch.net/book/dat/1000000001.dat")
+	})
+
+	Convey("Writes to retained entries do not count toward the limits", t, func() {
+		storage := &listCountingStorage{Storage: NewMemoryStorage()}
+		cache := NewMemoryCache()
+		cache.Storage = storage
+		cache.EvictionPolicy = EvictOldest
+		cache.ArchivedRetention = RetainForever
+
+		urls := make([]*url.URL, 2)
+		for i := range urls {
+			urls[i], _ = url.Parse(fmt.Sprintf("http://toro.2ch.net/book/dat/100000000%d.dat", i))
+		}
+
+		cache.GetEntry(urls[0]).FreshenContent([]byte("0123456789"), base)
+		So(cache.GetEntry(urls[0]).MarkArchived(), ShouldBeNil)
+		cache.GetEntry(urls[1]).FreshenContent([]byte("0123456789"), base)
+
+		cache.MaxEntries = 1
+		_, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(atomic.LoadInt32(&storage.lists), ShouldEqual, 1)
+
+		So(cache.GetEntry(urls[0]).SavePrevious(), ShouldBeNil)
+		cache.GetEntry(urls[0]).FreshenContentWithMeta([]byte("01234567890123456789"), base.Add(time.Hour), &CacheMeta{Archived: true})
+
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&storage.lists), ShouldEqual, 1)
+	})
+
+	Convey("Writes walk the storage only when exceeding the limits", t, func() {
+		storage := &listCountingStorage{Storage: NewMemoryStorage()}
+		cache := NewMemoryCache()
+		cache.Storage = storage
+		cache.EvictionPolicy = EvictOldest
+		cache.MaxEntries = 2
+
+		_, err := cache.Evict()
+		So(err, ShouldBeNil)
+		So(atomic.LoadInt32(&storage.lists), ShouldEqual, 1)
+
+		urls := make([]*url.URL, 3)
+		for i := range urls {
+			urls[i], _ = url.Parse(fmt.Sprintf("http://toro.2ch.net/book/dat/100000000%d.dat", i))
+		}
+
+		cache.GetEntry(urls[0]).FreshenContent([]byte("0123456789"), base)
+		cache.GetEntry(urls[1]).FreshenContent([]byte("0123456789"), base.Add(time.Hour))
+		cache.GetEntry(urls[1]).FreshenContent([]byte("01234567890123456789"), base.Add(2*time.Hour))
+		So(atomic.LoadInt32(&storage.lists), ShouldEqual, 1)
+
+		cache.GetEntry(urls[2]).FreshenContent([]byte("0123456789"), base.Add(3*time.Hour))
+
+		for i := 0; i < 100 && atomic.LoadInt32(&storage.lists) < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(atomic.LoadInt32(&storage.lists), ShouldEqual, 2)
+
+		for i := 0; i < 100; i++ {
+			if _, _, err := cache.GetEntry(urls[0]).GetContent(); err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, _, err = cache.GetEntry(urls[0]).GetContent()
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,71 @@
+package etch
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ParseHostDurations parses "host=duration,..." specification.
+func ParseHostDurations(s string) (map[string]time.Duration, error) {
+	hostDurations := make(map[string]time.Duration)
+	if s == "" {
+		return hostDurations, nil
+	}
+
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid host duration: %q", spec)
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		hostDurations[parts[0]] = d
+	}
+
+	return hostDurations, nil
+}
+
+// freshFor returns how long the cache of u is served without revalidation
+// after upstream was checked.
+func (proxy *ProxyServer) freshFor(u *url.URL) time.Duration {
+	suffixes := make([]string, 0, len(proxy.HostFreshFor))
+	for suffix := range proxy.HostFreshFor {
+		suffixes = append(suffixes, suffix)
+	}
+
+	if suffix, ok := longestHostSuffix(u.Hostname(), suffixes); ok {
+		return proxy.HostFreshFor[suffix]
+	}
+
+	return proxy.FreshFor
+}
+
+// freshCheckedAt returns when upstream was checked for entry, if it is
+// still within the freshness window.
+func (proxy *ProxyServer) freshCheckedAt(entry *CacheEntry) (time.Time, bool) {
+	freshFor := proxy.freshFor(entry.URL)
+	if freshFor <= 0 {
+		return time.Time{}, false
+	}
+
+	checkedAt, ok := proxy.checked.get(entry.Key)
+	if !ok || time.Since(checkedAt) >= freshFor {
+		return time.Time{}, false
+	}
+
+	return checkedAt, true
+}
+
+func newFreshResponse(req *http.Request, content *CacheContent, meta *CacheMeta, checkedAt time.Time) *http.Response {
+	resp := newCachedResponse(req, content, meta)
+	resp.Header.Set("Age", fmt.Sprint(int(time.Since(checkedAt).Seconds())))
+	resp.Header.Set("X-Etch-Checked-At", checkedAt.UTC().Format(http.TimeFormat))
+	return resp
+}
@@ -0,0 +1,278 @@
+package etch
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Cache keys are laid out as "<scheme>/<host[:port]>/<path segments...>",
+// each component escaped by url.PathEscape. The query string, if any, is
+// appended to the last segment after a literal "?", which PathEscape never
+// produces. Empty segments (eg. trailing slash) are written as "#", and dot
+// segments as "%2E", neither of which PathEscape produces either, so that
+// every key maps back to exactly one URL and never escapes the storage root.
+const emptySegment = "#"
+
+// Data accompanying entries, ie. meta and snapshots, are stored under
+// sidecarRoot, followed by the kind of data and the key of the entry. Keys
+// of URLs never start with it as "#" is escaped, so a URL ending with
+// ".meta" is cached as any other.
+const sidecarRoot = "#etch"
+
+var snapshotIDPattern = regexp.MustCompile(`#[0-9]+$`)
+
+func sidecarKey(kind, key string) string {
+	return sidecarRoot + "/" + kind + "/" + key
+}
+
+// entryKeyOf returns the key of the entry which key is of, or is a sidecar
+// of.
+func entryKeyOf(key string) string {
+	if !isSidecarKey(key) {
+		return key
+	}
+
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 {
+		return key
+	}
+
+	return snapshotIDPattern.ReplaceAllString(parts[2], "")
+}
+
+// isSidecarKey reports whether key is of data accompanying a cache entry,
+// rather than the content itself.
+func isSidecarKey(key string) bool {
+	return strings.HasPrefix(key, sidecarRoot+"/")
+}
+
+func escapeKeySegment(segment string) string {
+	switch segment {
+	case "":
+		return emptySegment
+	case ".", "..":
+		return strings.Replace(segment, ".", "%2E", -1)
+	default:
+		return url.PathEscape(segment)
+	}
+}
+
+// UrlNormalizer maps equivalent URLs of threads and boards to one.
+type UrlNormalizer struct {
+	// Mirror hosts mapped to the canonical ones
+	HostAliases map[string]string
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Normalize lowercases the host, drops the default port and resolves
+// HostAliases. For dat and subject.txt, whose content does not depend on
+// them, query and fragment are dropped and repeated slashes are squeezed.
+// u is left unmodified.
+func (n *UrlNormalizer) Normalize(u *url.URL) *url.URL {
+	normalized := *u
+	normalized.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.ToLower(u.Host)
+	if hostname, port := splitHostPort(host); port != "" && port == defaultPorts[normalized.Scheme] {
+		host = hostname
+	}
+	if alias, ok := n.HostAliases[host]; ok {
+		host = alias
+	}
+	normalized.Host = host
+
+	if strings.HasSuffix(u.Path, ".dat") || path.Base(u.Path) == "subject.txt" {
+		normalized.RawQuery = ""
+		normalized.ForceQuery = false
+		normalized.Fragment = ""
+
+		escaped := u.EscapedPath()
+		for strings.Contains(escaped, "//") {
+			escaped = strings.Replace(escaped, "//", "/", -1)
+		}
+		if p, err := url.PathUnescape(escaped); err == nil {
+			normalized.Path = p
+			normalized.RawPath = escaped
+		}
+	}
+
+	return &normalized
+}
+
+func splitHostPort(host string) (string, string) {
+	i := strings.LastIndex(host, ":")
+	if i == -1 || strings.HasSuffix(host, "]") {
+		return host, ""
+	}
+	return host[:i], host[i+1:]
+}
+
+// ParseHostAliases parses "alias=host,..." specification.
+func ParseHostAliases(s string) (map[string]string, error) {
+	hostAliases := make(map[string]string)
+	if s == "" {
+		return hostAliases, nil
+	}
+
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid host alias: %q", spec)
+		}
+
+		hostAliases[strings.ToLower(parts[0])] = strings.ToLower(parts[1])
+	}
+
+	return hostAliases, nil
+}
+
+// NormalizeUrl returns the URL by which u is cached and coalesced.
+func (cache *Cache) NormalizeUrl(u *url.URL) *url.URL {
+	if cache.Normalizer == nil {
+		return u
+	}
+	return cache.Normalizer(u)
+}
+
+func (cache *Cache) UrlToKey(u *url.URL) string {
+	u = cache.NormalizeUrl(u)
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	parts := []string{escapeKeySegment(scheme), escapeKeySegment(u.Host)}
+
+	// Split escaped path so that "%2F" in a segment is kept as is
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments[i] = escapeKeySegment(segment)
+	}
+
+	if u.RawQuery != "" {
+		segments[len(segments)-1] += "?" + url.PathEscape(u.RawQuery)
+	}
+
+	return strings.Join(append(parts, segments...), "/")
+}
+
+func (cache *Cache) KeyToUrl(key string) (*url.URL, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("invalid cache key: %q", key)
+	}
+
+	scheme, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	u := &url.URL{Scheme: scheme, Host: host}
+
+	segments := parts[2:]
+	last := segments[len(segments)-1]
+	if i := strings.Index(last, "?"); i != -1 {
+		rawQuery, err := url.PathUnescape(last[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		u.RawQuery = rawQuery
+		segments[len(segments)-1] = last[:i]
+	}
+
+	rawSegments := make([]string, len(segments))
+	for i, segment := range segments {
+		if segment == emptySegment {
+			segments[i] = ""
+			rawSegments[i] = ""
+			continue
+		}
+
+		segments[i], err = url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		rawSegments[i] = url.PathEscape(segments[i])
+	}
+
+	u.Path = "/" + strings.Join(segments, "/")
+	u.RawPath = "/" + strings.Join(rawSegments, "/")
+
+	return u, nil
+}
+
+// isLegacyKey reports whether key is in the layout of older etch,
+// "<host>/<path>", without scheme, port or query.
+func isLegacyKey(key string) bool {
+	scheme := strings.SplitN(key, "/", 2)[0]
+	return scheme != "http" && scheme != "https"
+}
+
+func legacyKeyToUrl(key string) *url.URL {
+	parts := strings.SplitN(key, "/", 2)
+	u := &url.URL{Scheme: "http", Host: parts[0], Path: "/"}
+	if len(parts) > 1 {
+		u.Path += parts[1]
+	}
+	return u
+}
+
+// MigrateLegacyKeys moves entries stored in the older layout to the
+// current one. Entries already in the current layout are left untouched.
+func (cache *Cache) MigrateLegacyKeys() (int, error) {
+	keys, err := cache.Storage.List()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+
+	for _, key := range keys {
+		if isSidecarKey(key) || !isLegacyKey(key) {
+			continue
+		}
+
+		newKey := cache.UrlToKey(legacyKeyToUrl(key))
+
+		infof(cache, "Migrating %s -> %s", key, newKey)
+
+		if err := moveStorageKey(cache.Storage, key, newKey); err != nil {
+			return migrated, err
+		}
+
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+func moveStorageKey(storage Storage, from, to string) error {
+	info, err := storage.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	content, err := storage.Get(from)
+	if err != nil {
+		return err
+	}
+
+	if err := storage.Put(to, content, info.ModTime()); err != nil {
+		return err
+	}
+
+	return storage.Delete(from)
+}
@@ -0,0 +1,107 @@
+package etch_test
+
+import (
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	cache := NewMemoryCache()
+
+	Convey("UrlToKey and KeyToUrl round-trip", t, func() {
+		for urlString, key := range map[string]string{
+			"http://toro.2ch.net/book/dat/1363665368.dat":   "http/toro.2ch.net/book/dat/1363665368.dat",
+			"https://toro.2ch.net/book/subject.txt":         "https/toro.2ch.net/book/subject.txt",
+			"http://localhost:8080/test/read.cgi?a=1&b=%3F": "http/localhost:8080/test/read.cgi?a=1&b=%253F",
+			"http://example.com/dir/":                       "http/example.com/dir/#",
+			"http://example.com/a%2Fb/c%3Fd":                "http/example.com/a%2Fb/c%3Fd",
+			"http://example.com/x/../y":                     "http/example.com/x/%2E%2E/y",
+		} {
+			u, err := url.Parse(urlString)
+			So(err, ShouldBeNil)
+
+			So(cache.UrlToKey(u), ShouldEqual, key)
+
+			u2, err := cache.KeyToUrl(key)
+			So(err, ShouldBeNil)
+			So(u2.String(), ShouldEqual, urlString)
+		}
+	})
+
+	Convey("KeyToUrl rejects malformed keys", t, func() {
+		_, err := cache.KeyToUrl("toro.2ch.net")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	cache := NewMemoryCache()
+
+	Convey("Equivalent URLs are mapped to one key", t, func() {
+		for _, urlString := range []string{
+			"http://toro.2ch.net/book/dat/1363665368.dat",
+			"http://TORO.2ch.net:80/book/dat/1363665368.dat",
+			"http://toro.2ch.net/book/dat/1363665368.dat?raw=0.0",
+			"http://toro.2ch.net//book/dat/1363665368.dat#1",
+		} {
+			u, err := url.Parse(urlString)
+			So(err, ShouldBeNil)
+			So(cache.UrlToKey(u), ShouldEqual, "http/toro.2ch.net/book/dat/1363665368.dat")
+			So(cache.GetEntry(u).URL.String(), ShouldEqual, "http://toro.2ch.net/book/dat/1363665368.dat")
+		}
+
+		u, _ := url.Parse("http://toro.2ch.net/book/subject.txt?foo")
+		So(cache.UrlToKey(u), ShouldEqual, "http/toro.2ch.net/book/subject.txt")
+	})
+
+	Convey("Queries of other URLs are kept", t, func() {
+		u, _ := url.Parse("http://toro.2ch.net:8080/test/read.cgi?a=1")
+		So(cache.UrlToKey(u), ShouldEqual, "http/toro.2ch.net:8080/test/read.cgi?a=1")
+	})
+
+	Convey("Mirror hosts are mapped to the canonical ones", t, func() {
+		aliases, err := ParseHostAliases("mirror.example.com=toro.2ch.net")
+		So(err, ShouldBeNil)
+
+		cache := NewMemoryCache()
+		cache.Normalizer = (&UrlNormalizer{HostAliases: aliases}).Normalize
+
+		u, _ := url.Parse("http://mirror.example.com/book/dat/1363665368.dat")
+		So(cache.UrlToKey(u), ShouldEqual, "http/toro.2ch.net/book/dat/1363665368.dat")
+
+		_, err = ParseHostAliases("mirror.example.com")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	Convey("Cache with legacy keys", t, func() {
+		storage := NewMemoryStorage()
+		cache := &Cache{Storage: storage}
+
+		mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+		storage.Put("toro.2ch.net/book/dat/1363665368.dat", []byte("foobar"), mtime)
+		storage.Put("http/toro.2ch.net/book/dat/1000000000.dat", []byte("baz"), mtime)
+		storage.Put("http/toro.2ch.net/test/read.cgi/book/1000000000.versions", []byte("qux"), mtime)
+		storage.Put("#etch/versions/http/toro.2ch.net/book/dat/1000000000.dat", []byte("[]"), mtime)
+
+		migrated, err := cache.MigrateLegacyKeys()
+		So(err, ShouldBeNil)
+		So(migrated, ShouldEqual, 1)
+
+		keys, _ := storage.List()
+		So(keys, ShouldResemble, []string{
+			"#etch/versions/http/toro.2ch.net/book/dat/1000000000.dat",
+			"http/toro.2ch.net/book/dat/1000000000.dat",
+			"http/toro.2ch.net/book/dat/1363665368.dat",
+			"http/toro.2ch.net/test/read.cgi/book/1000000000.versions",
+		})
+
+		info, err := storage.Stat("http/toro.2ch.net/book/dat/1363665368.dat")
+		So(err, ShouldBeNil)
+		So(info.ModTime().Equal(mtime), ShouldBeTrue)
+	})
+}
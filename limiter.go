@@ -0,0 +1,238 @@
+package etch
+
+import (
+	"errors"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLimiterCanceled = errors.New("canceled waiting for upstream")
+
+// HostLimiter throttles requests to upstream hosts, so as not to be banned
+// for polling too aggressively. Each host has its own token bucket and cap
+// on concurrent requests.
+type HostLimiter struct {
+	// Requests per second allowed on average, and in a burst; zero Rate
+	// means unlimited
+	Rate  float64
+	Burst int
+	// Requests in progress allowed at once; zero means unlimited
+	MaxConcurrent int
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+	queue map[*QueuedRequest]struct{}
+}
+
+type hostLimit struct {
+	tokens float64
+	last   time.Time
+	active int
+	// Capacity is MaxConcurrent at creation; nil if unlimited
+	slots chan struct{}
+}
+
+// QueuedRequest is a request waiting for the limits of its host.
+type QueuedRequest struct {
+	URL   string    `json:"url"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+type HostLimiterStats struct {
+	Active  int `json:"active"`
+	Waiting int `json:"waiting"`
+}
+
+func NewHostLimiter() *HostLimiter {
+	return &HostLimiter{
+		hosts: make(map[string]*hostLimit),
+		queue: make(map[*QueuedRequest]struct{}),
+	}
+}
+
+func (l *HostLimiter) host(host string) *hostLimit {
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{tokens: float64(l.burst()), last: time.Now()}
+		if l.MaxConcurrent > 0 {
+			h.slots = make(chan struct{}, l.MaxConcurrent)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+func (l *HostLimiter) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// Acquire waits until a request to u is allowed, or cancel is closed. The
+// returned func must be called when the request is done.
+func (l *HostLimiter) Acquire(u *url.URL, cancel <-chan struct{}) (func(), error) {
+	queued := &QueuedRequest{URL: u.String(), Host: u.Host, Since: time.Now()}
+
+	l.mu.Lock()
+	h := l.host(u.Host)
+	l.queue[queued] = struct{}{}
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.queue, queued)
+		l.mu.Unlock()
+	}()
+
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-cancel:
+			return nil, ErrLimiterCanceled
+		}
+	}
+
+	if err := l.takeToken(h, cancel); err != nil {
+		if h.slots != nil {
+			<-h.slots
+		}
+		return nil, err
+	}
+
+	l.mu.Lock()
+	h.active++
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			h.active--
+			l.mu.Unlock()
+
+			if h.slots != nil {
+				<-h.slots
+			}
+		})
+	}, nil
+}
+
+func (l *HostLimiter) takeToken(h *hostLimit, cancel <-chan struct{}) error {
+	for {
+		l.mu.Lock()
+		if l.Rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		now := time.Now()
+		h.tokens += now.Sub(h.last).Seconds() * l.Rate
+		if max := float64(l.burst()); h.tokens > max {
+			h.tokens = max
+		}
+		h.last = now
+
+		if h.tokens >= 1 {
+			h.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+
+		wait := time.Duration((1 - h.tokens) / l.Rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return ErrLimiterCanceled
+		}
+	}
+}
+
+// Queue returns the requests waiting, oldest first.
+func (l *HostLimiter) Queue() []*QueuedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	queue := make([]*QueuedRequest, 0, len(l.queue))
+	for queued := range l.queue {
+		copied := *queued
+		queue = append(queue, &copied)
+	}
+
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Since.Before(queue[j].Since) })
+
+	return queue
+}
+
+// Stats returns the numbers of requests by host.
+func (l *HostLimiter) Stats() map[string]HostLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make(map[string]HostLimiterStats, len(l.hosts))
+	for host, h := range l.hosts {
+		stats[host] = HostLimiterStats{Active: h.active}
+	}
+	for queued := range l.queue {
+		s := stats[queued.Host]
+		s.Waiting++
+		stats[queued.Host] = s
+	}
+
+	return stats
+}
+
+// limitRoundTrip sends req by roundTrip within the limits of its host. The
+// limits are released when the response body is closed.
+func (proxy *ProxyServer) limitRoundTrip(req *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	release, err := proxy.Limiter.Acquire(req.URL, req.Context().Done())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := roundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// LimitRequest makes requests not prepared by other handlers, eg. POST,
+// sent within the limits too.
+func (proxy *ProxyServer) LimitRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		return proxy.limitRoundTrip(req, proxy.Tr.RoundTrip)
+	})
+	return req, nil
+}
+
+// releasingReadCloser releases the limits on Close. Close may be called
+// more than once, eg. by goproxy and by the last of coalesced requests, and
+// concurrently with Read to interrupt a stalled upstream.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+	err     error
+}
+
+func (r *releasingReadCloser) Close() error {
+	r.once.Do(func() {
+		defer r.release()
+		r.err = r.ReadCloser.Close()
+	})
+	return r.err
+}
@@ -0,0 +1,83 @@
+package etch_test
+
+import (
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	u, _ := url.Parse("http://toro.2ch.net/book/dat/1363665368.dat")
+	other, _ := url.Parse("http://uni.2ch.net/newsplus/dat/1363665368.dat")
+
+	Convey("HostLimiter with MaxConcurrent", t, func() {
+		limiter := NewHostLimiter()
+		limiter.MaxConcurrent = 1
+
+		release, err := limiter.Acquire(u, nil)
+		So(err, ShouldBeNil)
+
+		acquired := make(chan func())
+		go func() {
+			release, _ := limiter.Acquire(u, nil)
+			acquired <- release
+		}()
+
+		for limiter.Stats()["toro.2ch.net"].Waiting == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		Convey("Queues requests to the same host", func() {
+			So(limiter.Stats()["toro.2ch.net"], ShouldResemble, HostLimiterStats{Active: 1, Waiting: 1})
+
+			queue := limiter.Queue()
+			So(len(queue), ShouldEqual, 1)
+			So(queue[0].URL, ShouldEqual, u.String())
+
+			releaseOther, err := limiter.Acquire(other, nil)
+			So(err, ShouldBeNil)
+			releaseOther()
+
+			release()
+			release()
+			(<-acquired)()
+
+			So(limiter.Stats()["toro.2ch.net"], ShouldResemble, HostLimiterStats{})
+		})
+
+		Convey("Stops waiting when canceled", func() {
+			cancel := make(chan struct{})
+			close(cancel)
+
+			_, err := limiter.Acquire(u, cancel)
+			So(err, ShouldEqual, ErrLimiterCanceled)
+
+			release()
+			(<-acquired)()
+		})
+	})
+
+	Convey("HostLimiter with Rate", t, func() {
+		limiter := NewHostLimiter()
+		limiter.Rate = 20
+		limiter.Burst = 2
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			release, err := limiter.Acquire(u, nil)
+			So(err, ShouldBeNil)
+			release()
+		}
+
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+
+		start = time.Now()
+		release, err := limiter.Acquire(other, nil)
+		So(err, ShouldBeNil)
+		release()
+
+		So(time.Since(start), ShouldBeLessThan, 40*time.Millisecond)
+	})
+}
@@ -10,7 +10,12 @@ type Listeners struct {
 }
 
 func (l *Listeners) Broadcast(e Event) {
-	for _, ch := range l.chans {
+	l.Lock()
+	chans := make([]chan Event, len(l.chans))
+	copy(chans, l.chans)
+	l.Unlock()
+
+	for _, ch := range chans {
 		ch <- e
 	}
 }
@@ -30,10 +35,11 @@ func (l *Listeners) Remove(ch <-chan Event) {
 	l.Lock()
 	defer l.Unlock()
 
-	l.chans = make([]chan Event, len(l.chans)-1)
+	chans := make([]chan Event, 0, len(l.chans))
 	for _, _ch := range l.chans {
 		if ch != _ch {
-			l.chans = append(l.chans, _ch)
+			chans = append(chans, _ch)
 		}
 	}
+	l.chans = chans
 }
@@ -29,12 +29,16 @@ func logConfig(context interface{}) (loggo.Logger, string, interface{}) {
 	switch context := context.(type) {
 	case *Cache:
 		return loggo.GetLogger("cache"), "%s", ""
+	case *FileStorage:
+		return loggo.GetLogger("cache"), "%s", ""
 	case *CacheEntry:
 		return loggo.GetLogger("cache"), "[%s] ", context.FilePath
 	case *goproxy.ProxyCtx:
 		return loggo.GetLogger("proxy"), "[%03d] ", context.Session & 0xFF
 	case *ProxyServer:
 		return loggo.GetLogger("proxy"), "%s", ""
+	case *Watcher:
+		return loggo.GetLogger("watcher"), "%s", ""
 	default:
 		return loggo.GetLogger(""), "[%s] ", context
 	}
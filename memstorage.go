@@ -0,0 +1,166 @@
+package etch
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps contents in memory. Useful for tests and
+// ephemeral deployments.
+type MemoryStorage struct {
+	sync.RWMutex
+	items map[string]*memoryItem
+}
+
+type memoryItem struct {
+	name    string
+	content []byte
+	mtime   time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{items: make(map[string]*memoryItem)}
+}
+
+func (ms *MemoryStorage) Get(key string) ([]byte, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	item, ok := ms.items[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+
+	return append([]byte(nil), item.content...), nil
+}
+
+func (ms *MemoryStorage) Open(key string) (StorageReader, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	item, ok := ms.items[key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	// item.content is never modified in place
+	return memoryReader{bytes.NewReader(item.content)}, nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Create(key string, mtime time.Time) (StorageWriter, error) {
+	return &memoryWriter{commit: func(content []byte) error {
+		return ms.Put(key, content, mtime)
+	}}, nil
+}
+
+func (ms *MemoryStorage) OpenAppend(key string, mtime time.Time) (StorageWriter, error) {
+	if _, err := ms.Stat(key); err != nil {
+		return nil, err
+	}
+
+	return &memoryWriter{commit: func(content []byte) error {
+		return ms.Append(key, content, mtime)
+	}}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	commit func([]byte) error
+}
+
+func (w *memoryWriter) Commit() error {
+	return w.commit(w.Bytes())
+}
+
+func (w *memoryWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+func (ms *MemoryStorage) Put(key string, content []byte, mtime time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.items[key] = &memoryItem{
+		name:    key,
+		content: append([]byte(nil), content...),
+		mtime:   mtime,
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) Append(key string, content []byte, mtime time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	item, ok := ms.items[key]
+	if !ok {
+		return &os.PathError{Op: "append", Path: key, Err: os.ErrNotExist}
+	}
+
+	ms.items[key] = &memoryItem{
+		name:    key,
+		content: append(append([]byte(nil), item.content...), content...),
+		mtime:   mtime,
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) Stat(key string) (os.FileInfo, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	item, ok := ms.items[key]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+
+	return item, nil
+}
+
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.items[key]; !ok {
+		return &os.PathError{Op: "delete", Path: key, Err: os.ErrNotExist}
+	}
+
+	delete(ms.items, key)
+
+	return nil
+}
+
+func (ms *MemoryStorage) List() ([]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	keys := make([]string, 0, len(ms.items))
+	for key := range ms.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// memoryItem implements os.FileInfo
+func (item *memoryItem) Name() string       { return item.name }
+func (item *memoryItem) Size() int64        { return int64(len(item.content)) }
+func (item *memoryItem) Mode() os.FileMode  { return 0666 }
+func (item *memoryItem) ModTime() time.Time { return item.mtime }
+func (item *memoryItem) IsDir() bool        { return false }
+func (item *memoryItem) Sys() interface{}   { return nil }
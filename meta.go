@@ -0,0 +1,116 @@
+package etch
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"time"
+)
+
+// CacheMeta is the sidecar record stored next to each cache entry.
+type CacheMeta struct {
+	ETag         string      `json:"etag,omitempty"`
+	ContentType  string      `json:"contentType,omitempty"`
+	StatusCode   int         `json:"statusCode,omitempty"` // of the whole content; 203 if dat落ち
+	LastModified time.Time   `json:"lastModified"`
+	FetchedAt    time.Time   `json:"fetchedAt"`
+	Encoding     string      `json:"encoding,omitempty"` // at rest
+	Size         int64       `json:"size"`               // decoded
+	LineCount    int         `json:"lineCount"`          // complete posts (see dat.CountPosts)
+	Header       http.Header `json:"header,omitempty"`
+	// SHA-256 of the decoded content, and its internal state to resume
+	// hashing on appends
+	Hash      string `json:"hash,omitempty"`
+	HashState []byte `json:"hashState,omitempty"`
+	// Set when the thread is dat落ち (responded with 203) and will not grow
+	Archived   bool      `json:"archived,omitempty"`
+	ArchivedAt time.Time `json:"archivedAt,omitempty"`
+}
+
+// Headers not worth remembering since they describe a particular response
+// rather than the content
+var volatileHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Content-Range",
+	"Date",
+	"Keep-Alive",
+	"Transfer-Encoding",
+}
+
+func NewCacheMeta(resp *http.Response) *CacheMeta {
+	header := make(http.Header)
+	for k, v := range resp.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	for _, k := range volatileHeaders {
+		header.Del(k)
+	}
+
+	return &CacheMeta{
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		StatusCode:  resp.StatusCode,
+		FetchedAt:   time.Now(),
+		Header:      header,
+	}
+}
+
+// Merge fills in fields missing in meta from older one; eg. 304 responses
+// usually lack Content-Type.
+func (meta *CacheMeta) Merge(older *CacheMeta) {
+	if older == nil {
+		return
+	}
+
+	if meta.ETag == "" {
+		meta.ETag = older.ETag
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = older.ContentType
+	}
+	if meta.Header == nil {
+		meta.Header = make(http.Header)
+	}
+	for k, v := range older.Header {
+		if _, ok := meta.Header[k]; !ok {
+			meta.Header[k] = v
+		}
+	}
+}
+
+func metaKey(key string) string {
+	return sidecarKey("meta", key)
+}
+
+func newContentHash() hash.Hash {
+	return sha256.New()
+}
+
+// restoreContentHash returns the hash resumed from state, or nil if state
+// is not available.
+func restoreContentHash(state []byte) hash.Hash {
+	if len(state) == 0 {
+		return nil
+	}
+
+	h := newContentHash()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil
+	}
+
+	return h
+}
+
+func (meta *CacheMeta) setContentHash(h hash.Hash) {
+	if h == nil {
+		meta.Hash = ""
+		meta.HashState = nil
+		return
+	}
+
+	meta.Hash = hex.EncodeToString(h.Sum(nil))
+	meta.HashState, _ = h.(encoding.BinaryMarshaler).MarshalBinary()
+}
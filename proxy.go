@@ -1,27 +1,73 @@
 package etch
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/elazarl/goproxy"
+	"github.com/motemen/etch/dat"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 )
 
 type ProxyServer struct {
 	goproxy.ProxyHttpServer
-	Cache        *Cache
-	RequestMutex *RequestMutex
+	Cache     *Cache
+	Coalescer *Coalescer
+	Limiter   *HostLimiter
+	Watcher   *Watcher
 	*Listeners
+	// Bytes of the cached content requested again to check that the
+	// response continues it, or OverlapLastLine
+	OverlapWindow int
+	// Whether cached content is served when upstream fails or times out
+	// revalidating it
+	ServeStale      bool
+	UpstreamTimeout time.Duration
+	// Whether to serve only from cache, never contacting upstream
+	Offline bool
+	// How long cached content is served without contacting upstream after
+	// it was checked, and its overrides by host suffix
+	FreshFor     time.Duration
+	HostFreshFor map[string]time.Duration
+
+	checked accessTable
 }
 
 type EtchContextData struct {
-	CachedContent *bytes.Buffer
+	CachedContent *CacheContent
+	CachedLength  int64
+	RangeStart    int64
+	Meta          *CacheMeta
+	StatusCode    int
+	// Whether the response is a verified continuation of the cached content
+	PartialContent bool
+	// Whether the response is served from cache without contacting upstream
+	CacheHit bool
+	// Whether the client accepts gzip-encoded response
+	AcceptGzip bool
+	// Whether the cache was invalidated and its previous version was saved
+	Invalidated bool
+	// Whether the response is of another ongoing request for the same URL
+	Coalesced bool
+	// Whether the cache is revalidated as a whole rather than by a range,
+	// as subject.txt is
+	Conditional bool
+
+	call *coalescedCall
+}
+
+func contextData(ctx *goproxy.ProxyCtx) *EtchContextData {
+	userData, ok := ctx.UserData.(*EtchContextData)
+	if !ok {
+		userData = &EtchContextData{}
+		ctx.UserData = userData
+	}
+	return userData
 }
 
 func reqMethodIs(method string) goproxy.ReqConditionFunc {
@@ -39,17 +85,21 @@ func statusCodeIs(code int) goproxy.RespCondition {
 	})
 }
 
-type RequestMutex struct {
-	sync.Mutex
-	resChans map[string][]chan *http.Response
-}
-
 func NewProxyServer(cacheDir string) *ProxyServer {
 	proxy := &ProxyServer{
 		ProxyHttpServer: *goproxy.NewProxyHttpServer(),
-		Cache:           &Cache{cacheDir},
-		RequestMutex:    &RequestMutex{resChans: make(map[string][]chan *http.Response)},
+		Cache:           NewCache(cacheDir),
+		Coalescer:       NewCoalescer(30 * time.Second),
+		Limiter:         NewHostLimiter(),
 		Listeners:       &Listeners{chans: make([]chan Event, 0)},
+		OverlapWindow:   OverlapLastLine,
+	}
+
+	proxy.Watcher = NewWatcher(proxy)
+
+	proxy.Cache.OnEvict = func(u *url.URL) {
+		proxy.checked.forget(proxy.Cache.UrlToKey(u))
+		proxy.Listeners.Broadcast(CacheDeleteEvent{URL: u})
 	}
 
 	proxy.Setup()
@@ -57,81 +107,283 @@ func NewProxyServer(cacheDir string) *ProxyServer {
 	return proxy
 }
 
-func (proxy *ProxyServer) GuardRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	proxy.RequestMutex.Lock()
-	chans, ok := proxy.RequestMutex.resChans[req.URL.String()]
+type contextKey int
 
-	if ok {
-		ch := make(chan *http.Response)
-		proxy.RequestMutex.resChans[req.URL.String()] = append(chans, ch)
-		proxy.RequestMutex.Unlock()
+const guardContextKey contextKey = iota
 
-		tracef(ctx, "[%s] Waiting for ongoing request", req.URL)
+// requestGuard remembers the call led by a request, so that its waiters
+// are released however the request ends, and the upstream body fetched for
+// them, so that they can keep reading it after the request ends.
+type requestGuard struct {
+	call *coalescedCall
+	body *detachableBody
+}
 
-		res := <-ch
+// guardBody makes the body of resp, fetched for req, detachable if req
+// leads a call.
+func guardBody(req *http.Request, resp *http.Response) *http.Response {
+	guard, ok := req.Context().Value(guardContextKey).(*requestGuard)
+	if !ok || guard.call == nil {
+		return resp
+	}
 
-		tracef(ctx, "[%s] Response got from chan: %s", req.URL, res)
+	guard.body = &detachableBody{ReadCloser: resp.Body}
+	resp.Body = guard.body
+	return resp
+}
+
+func (proxy *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	guard := &requestGuard{}
+	r = r.WithContext(context.WithValue(r.Context(), guardContextKey, guard))
 
-		if res != nil {
-			return req, res
+	defer func() {
+		// Usually done by UnguardRequest, but not when the request ended
+		// without reaching it, eg. on panics
+		if guard.call != nil {
+			proxy.Coalescer.Done(guard.call, nil, ErrCoalesceAborted)
 		}
-	} else {
-		proxy.RequestMutex.resChans[req.URL.String()] = make([]chan *http.Response, 0)
-		proxy.RequestMutex.Unlock()
+	}()
+
+	proxy.ProxyHttpServer.ServeHTTP(w, r)
+}
+
+// GuardRequest makes concurrent requests for the same cache key wait for the
+// first one, and receive a copy of its response.
+func (proxy *ProxyServer) GuardRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	userData := contextData(ctx)
+	userData.AcceptGzip = acceptsGzip(req.Header.Get("Accept-Encoding"))
+
+	call, leader := proxy.Coalescer.Join(proxy.Cache.UrlToKey(req.URL))
+	if leader {
+		userData.call = call
+		if guard, ok := req.Context().Value(guardContextKey).(*requestGuard); ok {
+			guard.call = call
+		}
+		return req, nil
+	}
+
+	userData.Coalesced = true
+
+	tracef(ctx, "[%s] Waiting for ongoing request", req.URL)
+
+	resp, err := proxy.Coalescer.Wait(call, req.Context().Done())
+	if err != nil {
+		infof(ctx, "[%s] Waiting for ongoing request failed: %s", req.URL, err)
+
+		status := http.StatusBadGateway
+		if err == ErrCoalesceTimeout {
+			status = http.StatusGatewayTimeout
+		}
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, status, err.Error())
 	}
 
-	return req, nil
+	tracef(ctx, "[%s] Response got from ongoing request: %s", req.URL, resp.Status)
+
+	return req, resp
 }
 
 func (proxy *ProxyServer) PrepareRangedRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 	cache := proxy.Cache
 	entry := cache.GetEntry(req.URL)
+	userData := contextData(ctx)
+
+	// Accept-Encoding from the client is not forwarded to upstream;
+	// upstream encoding is negotiated by ourselves
+	req.Header.Del("Accept-Encoding")
+	ctx.RoundTripper = goproxy.RoundTripperFunc(proxy.roundTripGzip)
 
-	content, mtime, err := entry.GetContent()
+	cachedContent, err := entry.OpenContent()
 
 	if err != nil {
 		errorf(ctx, "OnRequest: retrieving cache content: %s", err)
 		return req, nil
 	}
 
+	if cachedContent.Size() == 0 {
+		cachedContent.Close()
+		return req, nil
+	}
+
 	infof(ctx, "%s: found cache entry", req.URL)
 
-	cachedContent := bytes.NewBuffer(content)
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-", cachedContent.Len()-1))
+	meta, err := entry.GetMeta()
+	if err != nil {
+		warningf(ctx, "[%s] Reading cache meta: %s", req.URL, err)
+	}
+
+	if meta != nil && meta.Archived {
+		infof(ctx, "[%s] Archived; serving from cache", req.URL)
+		userData.CacheHit = true
+		return req, newCachedResponse(req, cachedContent, meta)
+	}
+
+	if proxy.Offline {
+		infof(ctx, "[%s] Offline; serving from cache", req.URL)
+		userData.CacheHit = true
+		return req, newStaleResponse(req, cachedContent, meta, StaleReasonOffline)
+	}
+
+	if checkedAt, ok := proxy.freshCheckedAt(entry); ok {
+		infof(ctx, "[%s] Checked at %s; serving from cache", req.URL, checkedAt)
+		userData.CacheHit = true
+		return req, newFreshResponse(req, cachedContent, meta, checkedAt)
+	}
+
+	var rangeStart int64
+	if isSubjectUrl(entry.URL) {
+		// subject.txt is rewritten as a whole
+		userData.Conditional = true
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		rangeStart, err = overlapStart(cachedContent, cachedContent.Size(), proxy.OverlapWindow)
+		if err != nil {
+			errorf(ctx, "[%s] Reading cache: %s", req.URL, err)
+			cachedContent.Close()
+			return req, nil
+		}
+
+		// Ranges must apply to the decoded content
+		req.Header.Set("Accept-Encoding", "identity")
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", rangeStart))
+	}
 	// なんか JST だと うまく 304 を返してくれないサーバがある…
-	req.Header.Add("If-Modified-Since", mtime.In(time.UTC).Format(time.RFC1123))
+	req.Header.Add("If-Modified-Since", cachedContent.ModTime.In(time.UTC).Format(time.RFC1123))
+	if meta != nil && meta.ETag != "" {
+		req.Header.Add("If-None-Match", meta.ETag)
+	}
 
 	tracef(ctx, "Request Headers (modified): %+v", req.Header)
 
-	_, resp, err := proxy.Tr.DetailedRoundTrip(req)
+	resp, err := proxy.detailedRoundTrip(req)
 	if err != nil {
 		errorf(ctx, "OnRequest: executing request: %s", err)
-		return req, nil
+		return req, proxy.upstreamErrorResponse(ctx, req, cachedContent, meta, err)
 	}
 
+	if proxy.ServeStale && isUpstreamFailure(resp.StatusCode) {
+		infof(ctx, "[%s] Got %d: serving stale cache", req.URL, resp.StatusCode)
+		resp.Body.Close()
+		userData.CacheHit = true
+		return req, newStaleResponse(req, cachedContent, meta, StaleReasonError)
+	}
+
+	userData.RangeStart = rangeStart
+
+	refetch := false
 	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
 		infof(ctx, "[%s] Got 416: attempting re-fetch", req.URL)
+		proxy.Listeners.Broadcast(CacheInvalidatedEvent{
+			URL:    req.URL,
+			Reason: InvalidationReasonRangeNotSatisfiable,
+			Detail: fmt.Sprintf("range %d- is not satisfiable", rangeStart),
+		})
+		userData.Invalidated = proxy.savePrevious(ctx, entry)
+		refetch = true
+	} else if resp.StatusCode == http.StatusPartialContent && !isIdentityEncoding(resp.Header.Get("Content-Encoding")) {
+		infof(ctx, "[%s] Got encoded partial content (%s): attempting re-fetch", req.URL, resp.Header.Get("Content-Encoding"))
+		refetch = true
+	}
 
-		// clear cache
-		req.Header.Del("Range")
-		req.Header.Del("If-Modified-Since")
+	if refetch {
+		resp.Body.Close()
 
-		_, _resp, err := proxy.Tr.DetailedRoundTrip(req)
+		// clear cache
+		prepareFullRequest(req)
 
+		resp, err = proxy.detailedRoundTrip(req)
 		if err != nil {
 			errorf(ctx, "OnRequest: re-fetch: %s", err)
-			return req, nil
+			return req, proxy.upstreamErrorResponse(ctx, req, cachedContent, meta, err)
 		}
 
-		resp = _resp
-		cachedContent = new(bytes.Buffer)
+		cachedContent.Close()
+		return req, resp
 	}
 
-	ctx.UserData = &EtchContextData{cachedContent}
+	userData.CachedContent = cachedContent
+	userData.CachedLength = cachedContent.Size()
+	userData.Meta = meta
 
 	return req, resp
 }
 
+// upstreamErrorResponse responds to req when the request to upstream
+// failed, with the cached content if stale cache may be served.
+func (proxy *ProxyServer) upstreamErrorResponse(ctx *goproxy.ProxyCtx, req *http.Request, cachedContent *CacheContent, meta *CacheMeta, err error) *http.Response {
+	if proxy.ServeStale {
+		infof(ctx, "[%s] Serving stale cache", req.URL)
+		contextData(ctx).CacheHit = true
+		return newStaleResponse(req, cachedContent, meta, StaleReasonError)
+	}
+	cachedContent.Close()
+
+	// Falling through would only send the request again
+	status := http.StatusBadGateway
+	if err == ErrUpstreamTimeout {
+		status = http.StatusGatewayTimeout
+	}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, status, err.Error())
+}
+
+// roundTripGzip is used for requests which goproxy sends by itself, that is,
+// full fetches. Accept-Encoding set here is not removed by goproxy, and
+// the transport does not decode the response, so it is done by
+// DecodeResponse.
+func (proxy *ProxyServer) roundTripGzip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	if req.Header.Get("Range") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// The response may be read on behalf of coalesced requests after the
+	// client has gone away
+	resp, err := proxy.limitRoundTrip(req.WithContext(context.WithoutCancel(req.Context())), proxy.Tr.RoundTrip)
+	if err != nil {
+		return nil, err
+	}
+
+	return guardBody(req, resp), nil
+}
+
+// prepareFullRequest turns a ranged request into one fetching the whole
+// content. gzip is requested explicitly, so the response is decoded by
+// DecodeResponse before stored.
+func prepareFullRequest(req *http.Request) {
+	req.Header.Del("Range")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("If-None-Match")
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+func newCachedResponse(req *http.Request, content *CacheContent, meta *CacheMeta) *http.Response {
+	resp := &http.Response{
+		Request:       req,
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          content,
+		ContentLength: content.Size(),
+	}
+
+	resp.Header.Set("Content-Type", goproxy.ContentTypeText)
+	setCacheHeaders(resp.Header, content, meta)
+
+	return resp
+}
+
+func (userData *EtchContextData) discardCachedContent() {
+	if userData.CachedContent != nil {
+		userData.CachedContent.Close()
+	}
+	userData.CachedContent = nil
+	userData.CachedLength = 0
+	userData.Meta = nil
+}
+
 func (proxy *ProxyServer) FixStatusCode(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 	switch resp.StatusCode {
 	case http.StatusNonAuthoritativeInfo:
@@ -144,77 +396,268 @@ func (proxy *ProxyServer) FixStatusCode(resp *http.Response, ctx *goproxy.ProxyC
 }
 
 func (proxy *ProxyServer) RestoreCache(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+
 	if ctx.UserData == nil {
 		return proxy.FixStatusCode(resp, ctx)
 	}
 
 	userData := ctx.UserData.(*EtchContextData)
+	if userData.CacheHit || userData.Coalesced {
+		return resp
+	}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// nop
+	userData.StatusCode = resp.StatusCode
+
+	if userData.CachedContent == nil {
+		return proxy.FixStatusCode(resp, ctx)
+	}
 
+	switch resp.StatusCode {
 	case http.StatusPartialContent:
-		buf := userData.CachedContent
+		cachedContent := userData.CachedContent
 
-		// TODO check Content-Range value
 		contentRange := resp.Header.Get("Content-Range")
 		debugf(ctx, "Content-Range: %s", contentRange)
 
-		// 1 バイトだけキャッシュと重複してるはずなので
-		// その部分を整合性チェックに使う
-		responseBody := bufio.NewReader(resp.Body)
-		firstByte, err := responseBody.ReadByte()
+		if err := checkPartialResponse(resp, userData.RangeStart); err != nil {
+			infof(ctx, "[%s] Invalid partial response: %s; deleting cache", ctx.Req.URL, err)
+			return proxy.refetchInvalidated(resp, ctx, InvalidationReasonContentRange, err.Error())
+		}
 
-		if err != nil {
+		// RangeStart 以降はキャッシュと重複してるはずなので
+		// その部分を整合性チェックに使う
+		overlapLength := userData.CachedLength - userData.RangeStart
+		responseOverlap := make([]byte, overlapLength)
+		if _, err := io.ReadFull(resp.Body, responseOverlap); err != nil {
 			errorf(ctx, "[%s] Reading response: %s", ctx.Req.URL, err)
+			userData.discardCachedContent()
 			return goproxy.NewResponse(
 				ctx.Req, goproxy.ContentTypeText, http.StatusInternalServerError, fmt.Sprintf("Reading response: %s", err))
 		}
 
-		if buf.Bytes()[buf.Len()-1] != firstByte {
-			infof(ctx, "[%s] Cache mismatch; deleting cache", ctx.Req.URL)
-
-			cacheEntry := proxy.Cache.GetEntry(ctx.Req.URL)
-			if err := cacheEntry.Delete(); err != nil {
-				errorf(ctx, "[%s] Deleting cache failed: %s", ctx.Req.URL, err)
-			}
-
-			debugf(ctx, "[%s] Attempting re-fetch", ctx.Req.URL)
-
-			ctx.Req.Header.Del("Range")
-			ctx.Req.Header.Del("If-Modified-Since")
-			ctx.UserData = nil
-
-			_, _resp, err := proxy.Tr.DetailedRoundTrip(ctx.Req)
-			if _resp == nil || err != nil {
-				errorf(ctx, "[%s] Re-fetch failed: %s", ctx.Req.URL, err)
-				return resp
-			}
+		cachedOverlap := make([]byte, overlapLength)
+		if _, err := cachedContent.ReadAt(cachedOverlap, userData.RangeStart); err != nil {
+			errorf(ctx, "[%s] Reading cache: %s", ctx.Req.URL, err)
+			userData.discardCachedContent()
+			return goproxy.NewResponse(
+				ctx.Req, goproxy.ContentTypeText, http.StatusInternalServerError, fmt.Sprintf("Reading cache: %s", err))
+		}
 
-			return _resp
+		if !bytes.Equal(cachedOverlap, responseOverlap) {
+			infof(ctx, "[%s] Cache mismatch; deleting cache", ctx.Req.URL)
+			return proxy.refetchInvalidated(resp, ctx, InvalidationReasonOverlap,
+				fmt.Sprintf("%d bytes from offset %d differ", overlapLength, userData.RangeStart))
 		}
 
 		// 差分データなのでキャッシュと結合
-		io.Copy(buf, responseBody)
-
 		resp.StatusCode = http.StatusOK
 		resp.Header.Del("Content-Range")
-		resp.Body = ioutil.NopCloser(buf)
+		resp.Body = &multiReadCloser{
+			Reader:      io.MultiReader(cachedContent, resp.Body),
+			multiCloser: multiCloser{cachedContent, resp.Body},
+		}
+		userData.PartialContent = true
 
 	case http.StatusNotModified, // キャッシュから更新なし
 		http.StatusNonAuthoritativeInfo: // DAT 落ち
 
+		if resp.StatusCode == http.StatusNonAuthoritativeInfo {
+			infof(ctx, "[%s] Marking as archived", ctx.Req.URL)
+			if err := proxy.Cache.GetEntry(ctx.Req.URL).MarkArchived(); err != nil {
+				warningf(ctx, "[%s] Marking as archived failed: %s", ctx.Req.URL, err)
+			}
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			proxy.checked.touch(proxy.Cache.UrlToKey(ctx.Req.URL))
+		}
+
+		resp.Body.Close()
 		resp.StatusCode = http.StatusOK
-		resp.Body = ioutil.NopCloser(userData.CachedContent)
+		resp.Body = userData.CachedContent
+
+	case http.StatusOK:
+		if userData.Conditional {
+			userData.discardCachedContent()
+			return proxy.FixStatusCode(resp, ctx)
+		}
+
+		// Range was not respected; got full content
+		return proxy.checkFullContent(resp, ctx)
 
 	default:
 		errorf(ctx, "[%s] Unhandled status code: %d", ctx.Req.URL, resp.StatusCode)
+		userData.discardCachedContent()
+	}
+
+	return resp
+}
+
+// DecodeResponse decodes gzip-encoded response from upstream, so that
+// following handlers deal with the decoded content.
+func (proxy *ProxyServer) DecodeResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || !isGzipEncoding(resp.Header.Get("Content-Encoding")) {
+		return resp
+	}
+
+	debugf(ctx, "[%s] Decoding gzip response", ctx.Req.URL)
+
+	if err := decodeGzipResponse(resp); err != nil {
+		errorf(ctx, "[%s] Decoding response: %s", ctx.Req.URL, err)
+		resp.Body.Close()
+		return goproxy.NewResponse(
+			ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("Decoding response: %s", err))
+	}
+
+	return resp
+}
+
+// EncodeResponse gzips the response for clients accepting it. Responses
+// which could be gzipped vary by Accept-Encoding, whether they are or not.
+func (proxy *ProxyServer) EncodeResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	userData, _ := ctx.UserData.(*EtchContextData)
+	if resp == nil || userData == nil {
+		return resp
+	}
+
+	if !isIdentityEncoding(resp.Header.Get("Content-Encoding")) || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/") {
+		return resp
+	}
+
+	addVary(resp.Header, "Accept-Encoding")
+
+	if !userData.AcceptGzip {
+		return resp
+	}
+
+	encoded := copyResponse(resp, newGzipReader(resp.Body))
+	encoded.Header.Set("Content-Encoding", "gzip")
+	encoded.Header.Del("Content-Length")
+	encoded.ContentLength = -1
+
+	return encoded
+}
+
+// refetchInvalidated deletes the cache which turned out not to be continued
+// by resp, and fetches the whole content again.
+func (proxy *ProxyServer) refetchInvalidated(resp *http.Response, ctx *goproxy.ProxyCtx, reason, detail string) *http.Response {
+	userData := ctx.UserData.(*EtchContextData)
+
+	resp.Body.Close()
+	userData.discardCachedContent()
+
+	cacheEntry := proxy.Cache.GetEntry(ctx.Req.URL)
+	if err := cacheEntry.Supersede(); err != nil {
+		warningf(ctx, "[%s] Saving previous version failed: %s", ctx.Req.URL, err)
+		if err := cacheEntry.Delete(); err != nil {
+			errorf(ctx, "[%s] Deleting cache failed: %s", ctx.Req.URL, err)
+		}
+	} else {
+		userData.Invalidated = true
+	}
+
+	proxy.Listeners.Broadcast(CacheInvalidatedEvent{URL: cacheEntry.URL, Reason: reason, Detail: detail})
+
+	debugf(ctx, "[%s] Attempting re-fetch", ctx.Req.URL)
+
+	prepareFullRequest(ctx.Req)
+
+	_resp, err := proxy.detailedRoundTrip(ctx.Req)
+	if _resp == nil || err != nil {
+		errorf(ctx, "[%s] Re-fetch failed: %s", ctx.Req.URL, err)
+		return goproxy.NewResponse(
+			ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, fmt.Sprintf("Re-fetch failed: %s", err))
+	}
+
+	userData.StatusCode = _resp.StatusCode
+
+	return proxy.DecodeResponse(_resp, ctx)
+}
+
+// checkFullContent checks by the hash whether the full content in resp
+// starts with the cached content. If it does, resp is treated as a verified
+// continuation of the cache, as if it was a partial content.
+func (proxy *ProxyServer) checkFullContent(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	userData := ctx.UserData.(*EtchContextData)
+
+	meta := userData.Meta
+	if meta == nil || meta.Hash == "" || meta.Size != userData.CachedLength {
+		userData.discardCachedContent()
+		return resp
+	}
+
+	prefix := make([]byte, userData.CachedLength)
+	n, err := io.ReadFull(resp.Body, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		errorf(ctx, "[%s] Reading response: %s", ctx.Req.URL, err)
+		userData.discardCachedContent()
+		return goproxy.NewResponse(
+			ctx.Req, goproxy.ContentTypeText, http.StatusInternalServerError, fmt.Sprintf("Reading response: %s", err))
 	}
 
+	prefix = prefix[:n]
+	resp.Body = &multiReadCloser{
+		Reader:      io.MultiReader(bytes.NewReader(prefix), resp.Body),
+		multiCloser: multiCloser{resp.Body},
+	}
+
+	h := newContentHash()
+	h.Write(prefix)
+	if int64(n) == userData.CachedLength && hex.EncodeToString(h.Sum(nil)) == meta.Hash {
+		debugf(ctx, "[%s] Full content continues the cache", ctx.Req.URL)
+		userData.CachedContent.Close()
+		userData.CachedContent = nil
+		userData.PartialContent = true
+		return resp
+	}
+
+	infof(ctx, "[%s] Full content does not continue the cache", ctx.Req.URL)
+	proxy.Listeners.Broadcast(CacheInvalidatedEvent{
+		URL:    ctx.Req.URL,
+		Reason: InvalidationReasonHash,
+		Detail: fmt.Sprintf("first %d bytes of content differ from cache", userData.CachedLength),
+	})
+	userData.Invalidated = proxy.savePrevious(ctx, proxy.Cache.GetEntry(ctx.Req.URL))
+	userData.discardCachedContent()
+
 	return resp
 }
 
+func (proxy *ProxyServer) savePrevious(ctx *goproxy.ProxyCtx, cacheEntry *CacheEntry) bool {
+	if err := cacheEntry.SavePrevious(); err != nil {
+		warningf(ctx, "[%s] Saving previous version failed: %s", ctx.Req.URL, err)
+		return false
+	}
+
+	return true
+}
+
+// broadcastRewrittenPosts compares the content just stored with its
+// previous version, and notifies posts rewritten.
+func (proxy *ProxyServer) broadcastRewrittenPosts(ctx *goproxy.ProxyCtx, cacheEntry *CacheEntry) {
+	diff, err := cacheEntry.DiffPrevious()
+	if err != nil {
+		warningf(ctx, "[%s] Comparing with previous version failed: %s", ctx.Req.URL, err)
+		return
+	}
+
+	if diff.Empty() {
+		return
+	}
+
+	infof(ctx, "[%s] Posts rewritten: %v, removed: %v", ctx.Req.URL, diff.Changed, diff.Removed)
+
+	proxy.Listeners.Broadcast(PostsRewrittenEvent{URL: cacheEntry.URL, Changed: diff.Changed, Removed: diff.Removed})
+}
+
+type multiReadCloser struct {
+	io.Reader
+	multiCloser
+}
+
 func (proxy *ProxyServer) StoreCache(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 	cache := proxy.Cache
 
@@ -227,36 +670,169 @@ func (proxy *ProxyServer) StoreCache(resp *http.Response, ctx *goproxy.ProxyCtx)
 		}
 	}
 
-	infof(ctx, "[%s] Update cache", ctx.Req.URL)
+	meta := NewCacheMeta(resp)
 
-	lineCount := 0
-	if userData, ok := ctx.UserData.(*EtchContextData); ok && userData.CachedContent != nil {
-		lineCount = strings.Count(userData.CachedContent.String(), "\n")
+	userData, _ := ctx.UserData.(*EtchContextData)
+	if userData != nil && (userData.CacheHit || userData.Coalesced) {
+		return resp
 	}
 
-	proxy.Listeners.Broadcast(CacheUpdateEvent{URL: resp.Request.URL, Since: lineCount + 1})
+	if !isIdentityEncoding(resp.Header.Get("Content-Encoding")) {
+		infof(ctx, "[%s] Not caching encoded content (%s)", ctx.Req.URL, resp.Header.Get("Content-Encoding"))
+		return resp
+	}
+
+	if userData != nil {
+		meta.Merge(userData.Meta)
+
+		switch userData.StatusCode {
+		case http.StatusNotModified, http.StatusNonAuthoritativeInfo:
+			// served from cache as is
+			return resp
+		}
+	}
+
+	infof(ctx, "[%s] Update cache", ctx.Req.URL)
 
 	cacheEntry := cache.GetEntry(ctx.Req.URL)
-	buf := new(bytes.Buffer)
-	io.Copy(buf, resp.Body)
-	_, err := cacheEntry.FreshenContent(buf.Bytes(), lastModified)
-	resp.Body = ioutil.NopCloser(buf)
 
-	if err != nil {
-		warningf(ctx, "[%s] FreshenContent failed: %s", ctx.Req.URL, err)
+	// Compared with the new one after stored
+	var previousSubjects []*ThreadSubject
+	if isSubjectUrl(cacheEntry.URL) {
+		previousSubjects, _ = cacheEntry.Subjects()
+	}
+
+	var (
+		w    *CacheWriter
+		err  error
+		skip int64
+	)
+
+	lineCount := 0
+	if userData != nil && userData.PartialContent {
+		lineCount = userData.cachedLineCount()
+
+		w, err = cacheEntry.AppendContent(userData.CachedLength, lastModified, meta)
+		if err == nil {
+			skip = userData.CachedLength
+		} else if err != ErrCacheNotFresh {
+			infof(ctx, "[%s] AppendContent failed, falling back to rewrite: %s", ctx.Req.URL, err)
+			w, err = cacheEntry.CreateContent(lastModified, meta)
+		}
+	} else {
+		w, err = cacheEntry.CreateContent(lastModified, meta)
+	}
+
+	if err == ErrCacheNotFresh {
+		return resp
+	} else if err != nil {
+		warningf(ctx, "[%s] Writing cache failed: %s", ctx.Req.URL, err)
+		return resp
+	}
+
+	tee := &cacheTeeReader{ReadCloser: resp.Body, w: w, skip: skip, ctx: ctx}
+	invalidated := userData != nil && userData.Invalidated
+	sizeBefore := w.size
+	tee.onCommit = func() {
+		proxy.checked.touch(cacheEntry.Key)
+		if w.size > sizeBefore {
+			proxy.Listeners.Broadcast(CacheUpdateEvent{URL: cacheEntry.URL, Since: lineCount + 1})
+		}
+		if invalidated {
+			proxy.broadcastRewrittenPosts(ctx, cacheEntry)
+		}
+		proxy.broadcastSubjectChanges(cacheEntry, previousSubjects)
 	}
+	resp.Body = tee
 
 	return resp
 }
 
+func (userData *EtchContextData) cachedLineCount() int {
+	if meta := userData.Meta; meta != nil && meta.Size == userData.CachedLength {
+		return meta.LineCount
+	}
+
+	lineCount, _ := dat.CountPosts(io.NewSectionReader(userData.CachedContent, 0, userData.CachedLength))
+	return lineCount
+}
+
+// cacheTeeReader writes what is read from the response body into the cache,
+// skipping first skip bytes which are already there. The cache is committed
+// on EOF, and aborted if the body is closed before that, eg. the client has
+// disconnected.
+type cacheTeeReader struct {
+	io.ReadCloser
+	w        *CacheWriter
+	skip     int64
+	ctx      *goproxy.ProxyCtx
+	onCommit func()
+	failed   bool
+}
+
+func (r *cacheTeeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	data := p[:n]
+	if r.skip > 0 {
+		k := r.skip
+		if k > int64(n) {
+			k = int64(n)
+		}
+		data = data[k:]
+		r.skip -= k
+	}
+
+	if len(data) > 0 {
+		if _, err := r.w.Write(data); err != nil {
+			warningf(r.ctx, "[%s] Writing cache failed: %s", r.ctx.Req.URL, err)
+			r.w.Abort()
+			r.failed = true
+		}
+	}
+
+	if err == io.EOF {
+		if err := r.w.Commit(); err != nil {
+			warningf(r.ctx, "[%s] Committing cache failed: %s", r.ctx.Req.URL, err)
+		} else if r.onCommit != nil && !r.failed {
+			r.onCommit()
+		}
+		r.onCommit = nil
+	} else if err != nil {
+		r.w.Abort()
+	}
+
+	return n, err
+}
+
+func (r *cacheTeeReader) Close() error {
+	r.w.Abort()
+	return r.ReadCloser.Close()
+}
+
+// UnguardRequest passes copies of the response, or the error if the request
+// failed, to the requests waiting in GuardRequest.
 func (proxy *ProxyServer) UnguardRequest(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	proxy.RequestMutex.Lock()
-	defer proxy.RequestMutex.Unlock()
-	if chans := proxy.RequestMutex.resChans[ctx.Req.URL.String()]; chans != nil {
-		for _, ch := range chans {
-			ch <- resp
+	userData, _ := ctx.UserData.(*EtchContextData)
+	if userData == nil || userData.call == nil {
+		return resp
+	}
+
+	err := ctx.Error
+	if resp == nil && err == nil {
+		err = ErrCoalesceAborted
+	}
+
+	proxy.Coalescer.Done(userData.call, resp, err)
+
+	// goproxy closes the upstream body when the client has gone away, while
+	// waiters may still be reading it
+	if resp != nil {
+		if shared, ok := resp.Body.(*sharedBodyReader); ok {
+			if guard, ok := ctx.Req.Context().Value(guardContextKey).(*requestGuard); ok && guard.body != nil {
+				shared.body.own(guard.body.detach())
+			}
 		}
-		delete(proxy.RequestMutex.resChans, ctx.Req.URL.String())
 	}
 
 	return resp
@@ -271,14 +847,22 @@ func (proxy *ProxyServer) Setup() {
 		})
 	}
 
+	proxy.OnRequest().DoFunc(proxy.LimitRequest)
 	proxy.OnRequest(reqMethodIs("GET")).DoFunc(proxy.GuardRequest)
 	proxy.OnRequest(reqMethodIs("GET")).DoFunc(proxy.PrepareRangedRequest)
+	proxy.OnRequest().DoFunc(proxy.RefuseOffline)
+	proxy.OnResponse().DoFunc(proxy.DecodeResponse)
 	proxy.OnResponse(reqMethodIs("GET")).DoFunc(proxy.RestoreCache)
 	proxy.OnResponse(goproxy.ContentTypeIs("text/plain"), reqMethodIs("GET"), statusCodeIs(200), goproxy.Not(goproxy.ReqHostIs(""))).DoFunc(proxy.StoreCache)
 	proxy.OnResponse().DoFunc(proxy.UnguardRequest)
+	proxy.OnResponse().DoFunc(proxy.EncodeResponse)
 
 	if logger, _, _ := logConfig(proxy); logger.IsDebugEnabled() {
 		proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil {
+				debugf(ctx, "Response: none (%s)", ctx.Error)
+				return resp
+			}
 			debugf(ctx, "Response: [%d] %s", resp.StatusCode, resp.Status)
 			tracef(ctx, "Response Headers: %+v", resp.Header)
 			return resp
@@ -0,0 +1,110 @@
+package etch
+
+import (
+	"context"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"net/http"
+	"time"
+)
+
+var ErrUpstreamTimeout = errors.New("timed out waiting for upstream")
+
+// Values of X-Etch-Stale header, telling why the cached content is served
+// without revalidation
+const (
+	StaleReasonOffline = "offline"
+	StaleReasonError   = "error"
+)
+
+var staleWarnings = map[string]string{
+	StaleReasonOffline: `112 - "Disconnected Operation"`,
+	StaleReasonError:   `111 - "Revalidation Failed"`,
+}
+
+func newStaleResponse(req *http.Request, content *CacheContent, meta *CacheMeta, reason string) *http.Response {
+	resp := newCachedResponse(req, content, meta)
+	resp.Header.Set("Warning", staleWarnings[reason])
+	resp.Header.Set("X-Etch-Stale", reason)
+	return resp
+}
+
+// isUpstreamFailure reports whether the status code means that upstream is
+// unavailable, in which case stale content may be served.
+func isUpstreamFailure(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (proxy *ProxyServer) transportRoundTrip(req *http.Request) (*http.Response, error) {
+	_, resp, err := proxy.Tr.DetailedRoundTrip(req)
+	return resp, err
+}
+
+// detailedRoundTrip sends req by proxy.Tr within the limits of the host,
+// giving up waiting for the response after UpstreamTimeout. The transport
+// cannot cancel requests, so a response arriving later is discarded.
+func (proxy *ProxyServer) detailedRoundTrip(req *http.Request) (*http.Response, error) {
+	// The response may be read on behalf of coalesced requests after the
+	// client has gone away
+	upstreamCtx := context.WithoutCancel(req.Context())
+
+	if proxy.UpstreamTimeout <= 0 {
+		resp, err := proxy.limitRoundTrip(req.WithContext(upstreamCtx), proxy.transportRoundTrip)
+		if err != nil {
+			return nil, err
+		}
+		return guardBody(req, resp), nil
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	// req may be modified and sent again after giving up
+	sendCtx, cancel := context.WithCancel(upstreamCtx)
+	sent := req.Clone(sendCtx)
+	done := make(chan result, 1)
+	go func() {
+		resp, err := proxy.limitRoundTrip(sent, proxy.transportRoundTrip)
+		done <- result{resp, err}
+	}()
+
+	timer := time.NewTimer(proxy.UpstreamTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			cancel()
+			return nil, r.err
+		}
+		r.resp.Body = &releasingReadCloser{ReadCloser: r.resp.Body, release: cancel}
+		return guardBody(req, r.resp), nil
+	case <-timer.C:
+		// Stop waiting for the limits if still
+		cancel()
+		go func() {
+			if r := <-done; r.resp != nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, ErrUpstreamTimeout
+	}
+}
+
+// RefuseOffline responds to requests which are not served from cache while
+// Offline, so that upstream is never contacted.
+func (proxy *ProxyServer) RefuseOffline(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !proxy.Offline {
+		return req, nil
+	}
+
+	infof(ctx, "[%s] Offline; not in cache", req.URL)
+
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "etch is offline and the content is not cached")
+}
@@ -0,0 +1,260 @@
+package etch
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is the backend which actually holds cache contents.
+// Keys are slash-separated relative paths generated by Cache.UrlToKey, or
+// of sidecars under sidecarRoot.
+// Errors for missing keys must satisfy os.IsNotExist.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Open(key string) (StorageReader, error)
+	Put(key string, content []byte, mtime time.Time) error
+	Create(key string, mtime time.Time) (StorageWriter, error)
+	Append(key string, content []byte, mtime time.Time) error
+	OpenAppend(key string, mtime time.Time) (StorageWriter, error)
+	Stat(key string) (os.FileInfo, error)
+	Delete(key string) error
+	List() ([]string, error)
+}
+
+type StorageReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// StorageWriter is returned by Storage.Create and Storage.OpenAppend.
+// Written content takes effect only after Commit; Abort discards it.
+type StorageWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// Temporary files are named with a prefix starting with "#", which never
+// appears at the start of a path segment of cache keys except the empty
+// segment marker itself.
+const tempFilePrefix = "#etch-tmp-"
+
+func isTempFile(filePath string) bool {
+	return strings.HasPrefix(filepath.Base(filePath), tempFilePrefix)
+}
+
+// FileStorage stores contents as plain files under Root, which is the
+// original layout of etch cache directory.
+type FileStorage struct {
+	Root string
+}
+
+func (fs *FileStorage) FilePath(key string) string {
+	return path.Join(fs.Root, key)
+}
+
+func (fs *FileStorage) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(fs.FilePath(key))
+}
+
+func (fs *FileStorage) Open(key string) (StorageReader, error) {
+	return os.Open(fs.FilePath(key))
+}
+
+func (fs *FileStorage) Put(key string, content []byte, mtime time.Time) error {
+	w, err := fs.Create(key, mtime)
+	if err != nil {
+		return err
+	}
+
+	return writeAndCommit(w, content)
+}
+
+// Create returns a writer to a temporary file in the same directory, which
+// is renamed into place on Commit, so that readers never see partial
+// content.
+func (fs *FileStorage) Create(key string, mtime time.Time) (StorageWriter, error) {
+	filePath := fs.FilePath(key)
+
+	dir, _ := path.Split(filePath)
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// ioutil.TempFile creates files with 0600
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &fileCreateWriter{File: file, filePath: filePath, mtime: mtime}, nil
+}
+
+type fileCreateWriter struct {
+	*os.File
+	filePath string
+	mtime    time.Time
+}
+
+func (w *fileCreateWriter) Commit() error {
+	tempPath := w.File.Name()
+
+	if err := syncAndClose(w.File); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Chtimes(tempPath, w.mtime, w.mtime); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, w.filePath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+func (w *fileCreateWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// Append writes content at the end of existing file. Unlike Put, readers
+// may observe the file partially appended, but the existing part is never
+// altered.
+func (fs *FileStorage) Append(key string, content []byte, mtime time.Time) error {
+	w, err := fs.OpenAppend(key, mtime)
+	if err != nil {
+		return err
+	}
+
+	return writeAndCommit(w, content)
+}
+
+// OpenAppend returns a writer appending to the existing file. On Abort
+// the file is truncated back to its original size.
+func (fs *FileStorage) OpenAppend(key string, mtime time.Time) (StorageWriter, error) {
+	file, err := os.OpenFile(fs.FilePath(key), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileAppendWriter{File: file, size: fileInfo.Size(), mtime: mtime}, nil
+}
+
+type fileAppendWriter struct {
+	*os.File
+	size  int64
+	mtime time.Time
+}
+
+func (w *fileAppendWriter) Commit() error {
+	if err := syncAndClose(w.File); err != nil {
+		return err
+	}
+
+	return os.Chtimes(w.File.Name(), w.mtime, w.mtime)
+}
+
+func (w *fileAppendWriter) Abort() error {
+	defer w.File.Close()
+	return w.File.Truncate(w.size)
+}
+
+func writeAndCommit(w StorageWriter, content []byte) error {
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit()
+}
+
+func syncAndClose(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// RemoveTempFiles removes temporary files left by interrupted writes.
+// Should be called on startup, before any writes take place.
+func (fs *FileStorage) RemoveTempFiles() error {
+	return filepath.Walk(fs.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == fs.Root {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() && isTempFile(path) {
+			infof(fs, "Removing orphaned temporary file: %s", path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fs *FileStorage) Stat(key string) (os.FileInfo, error) {
+	return os.Stat(fs.FilePath(key))
+}
+
+func (fs *FileStorage) Delete(key string) error {
+	return os.Remove(fs.FilePath(key))
+}
+
+func (fs *FileStorage) List() ([]string, error) {
+	keys := make([]string, 0)
+
+	err := filepath.Walk(fs.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == fs.Root {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || isTempFile(path) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(fs.Root, path)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, filepath.ToSlash(relPath))
+
+		return nil
+	})
+
+	return keys, err
+}
@@ -0,0 +1,152 @@
+package etch_test
+
+import (
+	. "github.com/motemen/etch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStorage(t *testing.T, name string, storage Storage) {
+	Convey(name, t, func() {
+		key := "toro.2ch.net/book/dat/1363665368.dat"
+
+		Convey("Get() of a nonexistent key returns error", func() {
+			content, err := storage.Get(key)
+			So(content, ShouldBeZeroValue)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Stat() of a nonexistent key returns error", func() {
+			_, err := storage.Stat(key)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Put(key, content, mtime)", func() {
+			mtime := time.Date(2013, 3, 19, 12, 0, 0, 0, time.UTC)
+			So(storage.Put(key, []byte("foobar"), mtime), ShouldBeNil)
+
+			Convey("Get() returns content", func() {
+				content, err := storage.Get(key)
+				So(err, ShouldBeNil)
+				So(content, ShouldResemble, []byte("foobar"))
+			})
+
+			Convey("Stat() returns mtime and size", func() {
+				info, err := storage.Stat(key)
+				So(err, ShouldBeNil)
+				So(info.ModTime().Equal(mtime), ShouldBeTrue)
+				So(info.Size(), ShouldEqual, 6)
+			})
+
+			Convey("List() contains key", func() {
+				keys, err := storage.List()
+				So(err, ShouldBeNil)
+				So(keys, ShouldResemble, []string{key})
+			})
+
+			Convey("Open() streams content", func() {
+				r, err := storage.Open(key)
+				So(err, ShouldBeNil)
+				defer r.Close()
+
+				content, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(content, ShouldResemble, []byte("foobar"))
+			})
+
+			Convey("OpenAppend() then Commit() appends content", func() {
+				w, err := storage.OpenAppend(key, mtime)
+				So(err, ShouldBeNil)
+				w.Write([]byte("baz"))
+				So(w.Commit(), ShouldBeNil)
+
+				content, _ := storage.Get(key)
+				So(content, ShouldResemble, []byte("foobarbaz"))
+			})
+
+			Convey("OpenAppend() then Abort() leaves content untouched", func() {
+				w, err := storage.OpenAppend(key, mtime)
+				So(err, ShouldBeNil)
+				w.Write([]byte("baz"))
+				So(w.Abort(), ShouldBeNil)
+
+				content, _ := storage.Get(key)
+				So(content, ShouldResemble, []byte("foobar"))
+			})
+
+			Convey("Create() then Abort() leaves content untouched", func() {
+				w, err := storage.Create(key, mtime)
+				So(err, ShouldBeNil)
+				w.Write([]byte("partial"))
+				So(w.Abort(), ShouldBeNil)
+
+				content, _ := storage.Get(key)
+				So(content, ShouldResemble, []byte("foobar"))
+
+				keys, _ := storage.List()
+				So(keys, ShouldResemble, []string{key})
+			})
+
+			Convey("Delete() removes content", func() {
+				So(storage.Delete(key), ShouldBeNil)
+
+				_, err := storage.Get(key)
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				keys, err := storage.List()
+				So(err, ShouldBeNil)
+				So(keys, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	testStorage(t, "A FileStorage", &FileStorage{Root: tmpDir})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, "A MemoryStorage", NewMemoryStorage())
+}
+
+func TestFileStorageTempFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etch_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	Convey("A FileStorage with orphaned temporary files", t, func() {
+		storage := &FileStorage{Root: tmpDir}
+		So(storage.Put("http/example.com/a.dat", []byte("a"), time.Now()), ShouldBeNil)
+
+		orphan := storage.FilePath("http/example.com/#etch-tmp-12345")
+		So(ioutil.WriteFile(orphan, []byte("partial"), 0644), ShouldBeNil)
+
+		Convey("List() ignores them", func() {
+			keys, err := storage.List()
+			So(err, ShouldBeNil)
+			So(keys, ShouldResemble, []string{"http/example.com/a.dat"})
+		})
+
+		Convey("RemoveTempFiles() removes them", func() {
+			So(storage.RemoveTempFiles(), ShouldBeNil)
+
+			_, err := os.Stat(orphan)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			content, err := storage.Get("http/example.com/a.dat")
+			So(err, ShouldBeNil)
+			So(content, ShouldResemble, []byte("a"))
+		})
+	})
+}
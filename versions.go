@@ -0,0 +1,263 @@
+package etch
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// CacheVersion is a snapshot of the content of a CacheEntry taken when it
+// was replaced non-incrementally. Snapshots are stored decoded.
+type CacheVersion struct {
+	ID           string    `json:"id"`
+	LastModified time.Time `json:"lastModified"`
+	SavedAt      time.Time `json:"savedAt"`
+	Size         int64     `json:"size"`
+}
+
+var versionIDPattern = regexp.MustCompile(`^[0-9]+$`)
+
+func versionsKey(key string) string {
+	return sidecarKey("versions", key)
+}
+
+// previousKey returns the key of the copy of the content before it was
+// last replaced, which is kept for DiffPrevious even if snapshots are
+// disabled.
+func previousKey(key string) string {
+	return sidecarKey("previous", key)
+}
+
+// versionKey returns the key of the snapshot of id, next to versionsKey.
+// "#" never appears in a segment of keys but as a whole.
+func versionKey(key, id string) string {
+	return versionsKey(key) + "#" + id
+}
+
+// Versions returns the snapshots of the entry, oldest first.
+func (cacheEntry *CacheEntry) Versions() ([]*CacheVersion, error) {
+	cacheEntry.RLock()
+	defer cacheEntry.RUnlock()
+
+	return cacheEntry.versions()
+}
+
+func (cacheEntry *CacheEntry) versions() ([]*CacheVersion, error) {
+	versions := make([]*CacheVersion, 0)
+
+	data, err := cacheEntry.cache.Storage.Get(versionsKey(cacheEntry.Key))
+	if os.IsNotExist(err) {
+		return versions, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (cacheEntry *CacheEntry) putVersions(versions []*CacheVersion) error {
+	if len(versions) == 0 {
+		if err := cacheEntry.cache.Storage.Delete(versionsKey(cacheEntry.Key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+
+	return cacheEntry.cache.Storage.Put(versionsKey(cacheEntry.Key), data, time.Now())
+}
+
+// OpenVersion opens the snapshot of id.
+func (cacheEntry *CacheEntry) OpenVersion(id string) (*CacheContent, error) {
+	cacheEntry.RLock()
+	defer cacheEntry.RUnlock()
+
+	return cacheEntry.openVersion(id)
+}
+
+func (cacheEntry *CacheEntry) openVersion(id string) (*CacheContent, error) {
+	key := versionKey(cacheEntry.Key, id)
+
+	// id may come from outside; must not form another key
+	if !versionIDPattern.MatchString(id) {
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	return cacheEntry.openSidecarContent(key)
+}
+
+func (cacheEntry *CacheEntry) openSidecarContent(key string) (*CacheContent, error) {
+	fileInfo, err := cacheEntry.cache.Storage.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := cacheEntry.cache.Storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CacheContent{
+		SectionReader: io.NewSectionReader(r, 0, fileInfo.Size()),
+		ModTime:       fileInfo.ModTime(),
+		closer:        r,
+	}, nil
+}
+
+// SavePrevious saves the current content to be compared with the new
+// content by DiffPrevious, and as a new snapshot unless Cache.MaxVersions is
+// zero. Snapshots exceeding Cache.MaxVersions are removed, oldest first.
+func (cacheEntry *CacheEntry) SavePrevious() error {
+	cacheEntry.Lock()
+	defer cacheEntry.Unlock()
+
+	return cacheEntry.savePrevious()
+}
+
+func (cacheEntry *CacheEntry) savePrevious() error {
+	content, err := cacheEntry.openContent()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	debugf(cacheEntry, "Saving previous content")
+
+	if err := cacheEntry.copyContentTo(previousKey(cacheEntry.Key), content); err != nil {
+		return err
+	}
+
+	maxVersions := cacheEntry.cache.MaxVersions
+	if maxVersions <= 0 {
+		return nil
+	}
+
+	versions, err := cacheEntry.versions()
+	if err != nil {
+		return err
+	}
+
+	version := &CacheVersion{
+		ID:           strconv.FormatInt(time.Now().UnixNano(), 10),
+		LastModified: content.ModTime,
+		SavedAt:      time.Now(),
+		Size:         content.Size(),
+	}
+
+	debugf(cacheEntry, "Saving version %s", version.ID)
+
+	if err := cacheEntry.copyContentTo(versionKey(cacheEntry.Key, version.ID), content); err != nil {
+		return err
+	}
+
+	versions = append(versions, version)
+	for len(versions) > maxVersions {
+		if err := cacheEntry.cache.Storage.Delete(versionKey(cacheEntry.Key, versions[0].ID)); err != nil && !os.IsNotExist(err) {
+			warningf(cacheEntry, "Deleting version %s: %s", versions[0].ID, err)
+		}
+		cacheEntry.cache.usage.addSidecar(cacheEntry.Key, -versions[0].Size)
+		versions = versions[1:]
+	}
+
+	return cacheEntry.putVersions(versions)
+}
+
+// copyContentTo stores content decoded at key, with its mtime.
+func (cacheEntry *CacheEntry) copyContentTo(key string, content *CacheContent) error {
+	replaced := int64(0)
+	if fileInfo, err := cacheEntry.cache.Storage.Stat(key); err == nil {
+		replaced = fileInfo.Size()
+	}
+
+	w, err := cacheEntry.cache.Storage.Create(key, content.ModTime)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, io.NewSectionReader(content, 0, content.Size())); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if err := w.Commit(); err != nil {
+		return err
+	}
+
+	cacheEntry.cache.usage.addSidecar(cacheEntry.Key, content.Size()-replaced)
+	return nil
+}
+
+// Supersede moves the current content to a new snapshot, leaving the entry
+// without content.
+func (cacheEntry *CacheEntry) Supersede() error {
+	cacheEntry.Lock()
+	defer cacheEntry.Unlock()
+
+	if err := cacheEntry.savePrevious(); err != nil {
+		return err
+	}
+
+	if err := cacheEntry.cache.Storage.Delete(metaKey(cacheEntry.Key)); err != nil && !os.IsNotExist(err) {
+		warningf(cacheEntry, "Deleting meta: %s", err)
+	}
+
+	cacheEntry.cache.usage.deleteContent(cacheEntry.Key)
+
+	return cacheEntry.cache.Storage.Delete(cacheEntry.Key)
+}
+
+// DiffPrevious compares the content saved by SavePrevious with the current
+// one.
+func (cacheEntry *CacheEntry) DiffPrevious() (*LineDiff, error) {
+	cacheEntry.RLock()
+	defer cacheEntry.RUnlock()
+
+	previous, err := cacheEntry.openSidecarContent(previousKey(cacheEntry.Key))
+	if err != nil {
+		return nil, err
+	}
+	defer previous.Close()
+
+	content, err := cacheEntry.openContent()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	return diffLines(previous, content)
+}
+
+// DeleteVersions deletes all of the snapshots.
+func (cacheEntry *CacheEntry) DeleteVersions() error {
+	cacheEntry.Lock()
+	defer cacheEntry.Unlock()
+
+	return cacheEntry.deleteVersions()
+}
+
+func (cacheEntry *CacheEntry) deleteVersions() error {
+	versions, err := cacheEntry.versions()
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if err := cacheEntry.cache.Storage.Delete(versionKey(cacheEntry.Key, version.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		cacheEntry.cache.usage.addSidecar(cacheEntry.Key, -version.Size)
+	}
+
+	return cacheEntry.putVersions(nil)
+}
@@ -0,0 +1,253 @@
+package etch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Watcher refreshes the cache of watched threads in background, so that
+// updates are noticed without clients requesting them. Threads are checked
+// more often while growing, and less often while not.
+type Watcher struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	proxy   *ProxyServer
+	mu      sync.Mutex
+	threads map[string]*WatchedThread
+	wake    chan struct{}
+}
+
+type WatchedThread struct {
+	URL         *url.URL
+	Interval    time.Duration
+	NextCheck   time.Time
+	LastChecked time.Time
+	LastGrown   time.Time
+}
+
+func (thread *WatchedThread) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"url":         thread.URL.String(),
+		"interval":    thread.Interval.Seconds(),
+		"nextCheck":   thread.NextCheck,
+		"lastChecked": thread.LastChecked,
+		"lastGrown":   thread.LastGrown,
+	})
+}
+
+func NewWatcher(proxy *ProxyServer) *Watcher {
+	return &Watcher{
+		MinInterval: time.Minute,
+		MaxInterval: time.Hour,
+		proxy:       proxy,
+		threads:     make(map[string]*WatchedThread),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Watch adds u to the watch list, to be checked immediately. It reports
+// whether u was not watched yet.
+func (watcher *Watcher) Watch(u *url.URL) bool {
+	entry := watcher.proxy.Cache.GetEntry(u)
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if _, ok := watcher.threads[entry.Key]; ok {
+		return false
+	}
+
+	watcher.threads[entry.Key] = &WatchedThread{
+		URL:       entry.URL,
+		Interval:  watcher.MinInterval,
+		NextCheck: time.Now(),
+	}
+	watcher.notify()
+
+	return true
+}
+
+// Unwatch removes u from the watch list. It reports whether u was watched.
+func (watcher *Watcher) Unwatch(u *url.URL) bool {
+	key := watcher.proxy.Cache.UrlToKey(u)
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if _, ok := watcher.threads[key]; !ok {
+		return false
+	}
+
+	delete(watcher.threads, key)
+	watcher.notify()
+
+	return true
+}
+
+// Threads returns the watched threads, in the order of next check.
+func (watcher *Watcher) Threads() []*WatchedThread {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	threads := make([]*WatchedThread, 0, len(watcher.threads))
+	for _, thread := range watcher.threads {
+		copied := *thread
+		threads = append(threads, &copied)
+	}
+
+	sort.Slice(threads, func(i, j int) bool { return threads[i].NextCheck.Before(threads[j].NextCheck) })
+
+	return threads
+}
+
+func (watcher *Watcher) notify() {
+	select {
+	case watcher.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the scheduler. Call the returned function to stop it.
+func (watcher *Watcher) Start() func() {
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			wait := watcher.checkDue()
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-watcher.wake:
+				timer.Stop()
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// checkDue checks the threads due, and returns how long to wait for the
+// next one.
+func (watcher *Watcher) checkDue() time.Duration {
+	for {
+		next, wait := watcher.next()
+		if next == nil || wait > 0 {
+			return wait
+		}
+
+		watcher.check(next)
+	}
+}
+
+func (watcher *Watcher) next() (*WatchedThread, time.Duration) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	var next *WatchedThread
+	for _, thread := range watcher.threads {
+		if next == nil || thread.NextCheck.Before(next.NextCheck) {
+			next = thread
+		}
+	}
+
+	if next == nil {
+		return nil, watcher.MaxInterval
+	}
+
+	return next, time.Until(next.NextCheck)
+}
+
+// check fetches the thread through the proxy, as clients do, so that the
+// cache is updated and events are broadcast in the same way.
+func (watcher *Watcher) check(thread *WatchedThread) {
+	entry := watcher.proxy.Cache.GetEntry(thread.URL)
+	sizeBefore := contentSize(entry)
+
+	debugf(watcher, "[%s] Checking", thread.URL)
+
+	req, err := http.NewRequest("GET", thread.URL.String(), nil)
+	if err != nil {
+		errorf(watcher, "[%s] Creating request: %s", thread.URL, err)
+		watcher.Unwatch(thread.URL)
+		return
+	}
+
+	rw := &discardResponseWriter{header: make(http.Header)}
+	watcher.proxy.ServeHTTP(rw, req)
+
+	sizeAfter := contentSize(entry)
+	grown := sizeAfter > sizeBefore
+
+	meta, err := entry.GetMeta()
+	if err != nil {
+		warningf(watcher, "[%s] Reading cache meta: %s", thread.URL, err)
+	}
+
+	if meta != nil && meta.Archived {
+		infof(watcher, "[%s] Archived; unwatching", thread.URL)
+		watcher.Unwatch(thread.URL)
+		return
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	now := time.Now()
+	thread.LastChecked = now
+
+	if grown {
+		thread.LastGrown = now
+		thread.Interval /= 2
+	} else {
+		thread.Interval *= 2
+	}
+	if thread.Interval < watcher.MinInterval {
+		thread.Interval = watcher.MinInterval
+	}
+	if thread.Interval > watcher.MaxInterval {
+		thread.Interval = watcher.MaxInterval
+	}
+
+	thread.NextCheck = now.Add(thread.Interval)
+
+	debugf(watcher, "[%s] Got %d (%d -> %d bytes); next check in %s", thread.URL, rw.statusCode, sizeBefore, sizeAfter, thread.Interval)
+}
+
+func contentSize(entry *CacheEntry) int64 {
+	content, err := entry.OpenContent()
+	if err != nil {
+		return 0
+	}
+	defer content.Close()
+
+	return content.Size()
+}
+
+type discardResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (rw *discardResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *discardResponseWriter) WriteHeader(statusCode int) {
+	rw.statusCode = statusCode
+}
+
+func (rw *discardResponseWriter) Write(p []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	return len(p), nil
+}